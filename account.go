@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/calmh/gmailsync/imap"
+	"github.com/calmh/ini"
+)
+
+// An account is a section of the config file describing one mailbox to
+// sync: either [gmail], or one of any number of [account:<name>] sections.
+type account struct {
+	name    string
+	section string
+	cfg     ini.Config
+	tokens  imap.TokenSource
+
+	mut  sync.Mutex
+	pass string
+}
+
+// get returns the value of key in the account section. The email, password,
+// server, port, mailbox and tls keys default to the parts of the url key.
+func (a *account) get(key string) string {
+	v := a.cfg.Get(a.section, key)
+	if v != "" || key == "url" {
+		return v
+	}
+	u, err := a.url()
+	if err != nil || u == nil {
+		return ""
+	}
+	switch key {
+	case "email":
+		return u.User.Username()
+	case "password":
+		pass, _ := u.User.Password()
+		return pass
+	case "server":
+		return u.Hostname()
+	case "port":
+		return u.Port()
+	case "mailbox":
+		return strings.TrimPrefix(u.Path, "/")
+	case "tls":
+		if u.Scheme == "imap" {
+			return "starttls"
+		}
+	}
+	return ""
+}
+
+// url returns the parsed url key, such as
+// imaps://jb@example.com:secret@imap.gmail.com/%5BGmail%5D/All%20Mail, or
+// nil if there is none. imap:// URLs are for servers with STARTTLS.
+func (a *account) url() (*url.URL, error) {
+	s := a.cfg.Get(a.section, "url")
+	if s == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, errors.New("url: " + err.Error())
+	}
+	switch u.Scheme {
+	case "imaps", "imap":
+	default:
+		return nil, errors.New("url: " + strconv.Quote(s) + " is not an imaps:// or imap:// URL")
+	}
+	if u.User == nil || u.Hostname() == "" {
+		return nil, errors.New("url: expected " + u.Scheme + "://user:password@host[:port][/mailbox]")
+	}
+	return u, nil
+}
+
+// password returns the account password, given inline with password or read
+// from the environment variable, file or command output given by
+// password_env, password_file or password_cmd. It is looked up once and then
+// remembered.
+func (a *account) password() (string, error) {
+	defer a.mut.Unlock()
+	a.mut.Lock()
+	if a.pass != "" {
+		return a.pass, nil
+	}
+
+	var pass string
+	switch {
+	case a.get("password_env") != "":
+		name := a.get("password_env")
+		pass = os.Getenv(name)
+		if pass == "" {
+			return "", errors.New("Environment variable " + name + " is not set")
+		}
+	case a.get("password_file") != "":
+		bs, err := ioutil.ReadFile(a.get("password_file"))
+		if err != nil {
+			return "", err
+		}
+		pass = strings.TrimRight(string(bs), "\r\n")
+	case a.get("password_cmd") != "":
+		cmd := exec.Command("sh", "-c", a.get("password_cmd"))
+		if runtime.GOOS == "windows" {
+			cmd = exec.Command("cmd", "/C", a.get("password_cmd"))
+		}
+		cmd.Stderr = os.Stderr
+		bs, err := cmd.Output()
+		if err != nil {
+			return "", errors.New("password_cmd: " + err.Error())
+		}
+		pass = strings.TrimRight(string(bs), "\r\n")
+	default:
+		pass = a.get("password")
+	}
+
+	a.pass = pass
+	return pass, nil
+}
+
+// encryptionKey returns the passphrase for encrypting the vault, given
+// inline with encryption_key or read from encryption_key_file, or the empty
+// string if the vault is not to be encrypted.
+func (a *account) encryptionKey() (string, error) {
+	if f := a.get("encryption_key_file"); f != "" {
+		bs, err := ioutil.ReadFile(f)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(bs), "\r\n"), nil
+	}
+	return a.get("encryption_key"), nil
+}
+
+// selectAccounts returns the account with the given name, or all configured
+// accounts if name is empty. The -vault option replaces the vault of the
+// account, which must then be the only one.
+func selectAccounts(cfg ini.Config, name string) ([]*account, error) {
+	var accounts []*account
+	for _, section := range cfg.Sections() {
+		var accName string
+		switch {
+		case section == "gmail":
+			accName = "gmail"
+		case strings.HasPrefix(section, "account:"):
+			accName = strings.TrimPrefix(section, "account:")
+		default:
+			continue
+		}
+		if name != "" && name != accName {
+			continue
+		}
+
+		acc := &account{name: accName, section: section, cfg: cfg}
+		acc.tokens = tokenSource(acc)
+		accounts = append(accounts, acc)
+	}
+
+	if len(accounts) == 0 {
+		if name != "" {
+			return nil, errors.New("No account " + name + " in " + configFile)
+		}
+		return nil, errors.New("No accounts configured in " + configFile)
+	}
+	if vaultPath != "" {
+		if len(accounts) > 1 {
+			return nil, errors.New("Multiple accounts configured; select one with -account to use -vault")
+		}
+		accounts[0].cfg.Set(accounts[0].section, "vault", vaultPath)
+	}
+	return accounts, nil
+}
+
+// check returns an error naming the first key acc lacks for operation. The
+// vault is needed by everything but list, and the email address and some
+// way of logging in by the commands talking to the server.
+func (a *account) check(operation string) error {
+	missing := func(what string) error {
+		return fmt.Errorf("%s: [%s] has no %s", configFile, a.section, what)
+	}
+	if _, err := a.url(); err != nil {
+		return fmt.Errorf("%s: [%s] %v", configFile, a.section, err)
+	}
+	switch t := a.get("tls"); t {
+	case "", "implicit", "starttls":
+	default:
+		return fmt.Errorf("%s: [%s] tls must be implicit or starttls, not %q", configFile, a.section, t)
+	}
+	if operation != "list" && a.get("vault") == "" {
+		return missing("vault")
+	}
+	switch operation {
+	case "list", "fetch", "backfill", "daemon":
+	default:
+		return nil
+	}
+	if a.get("email") == "" {
+		return missing("email")
+	}
+	if a.get("refresh_token") != "" && (a.get("client_id") == "" || a.get("client_secret") == "") {
+		return missing("client_id or client_secret for refresh_token")
+	}
+	for _, key := range []string{"password", "password_env", "password_file", "password_cmd", "oauth_token", "refresh_token"} {
+		if a.get(key) != "" {
+			return nil
+		}
+	}
+	return missing("password, password_env, password_file, password_cmd, oauth_token or refresh_token")
+}
+
+// loadConfig reads and parses the config file name.
+func loadConfig(name string) (ini.Config, error) {
+	bs, err := ioutil.ReadFile(name)
+	if os.IsNotExist(err) {
+		return ini.Config{}, fmt.Errorf("Configuration file %s does not exist; create an example with -init, or give another with -cfg", name)
+	}
+	if err != nil {
+		return ini.Config{}, fmt.Errorf("Reading configuration: %v", err)
+	}
+	err = checkConfigSyntax(bs)
+	if err != nil {
+		return ini.Config{}, err
+	}
+	return ini.Parse(bytes.NewReader(bs)), nil
+}
+
+// checkConfigSyntax returns an error for the first line of the config file
+// that is neither a section header, a key = value pair, a comment nor
+// blank, since the parser silently ignores those.
+func checkConfigSyntax(bs []byte) error {
+	for i, line := range strings.Split(string(bs), "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "", line[0] == ';', line[0] == '#':
+		case line[0] == '[' && strings.HasSuffix(line, "]"):
+		case strings.Index(line, "=") > 0:
+		default:
+			return fmt.Errorf("%s:%d: expected [section] or key = value, not %q", configFile, i+1, line)
+		}
+	}
+	return nil
+}
+
+const exampleConfig = `; gmailsync configuration. See the README for all settings.
+
+[gmail]
+email = jb@example.com
+
+; The password, or with two factor authentication an app password. Use
+; password_env, password_file or password_cmd to keep it out of this file,
+; or refresh_token, client_id and client_secret for OAuth.
+password = secret
+
+; The mailbox to sync, All Mail by default whatever its localized name;
+; several may be given separated by commas
+;mailbox = [Gmail]/All Mail
+
+; The archive file
+vault = /var/lib/gmailsync/jb.vault
+
+; Number of IMAP connections, for scanning and fetching
+connections = 4
+`
+
+// writeExampleConfig writes a commented example configuration to name,
+// which must not exist.
+func writeExampleConfig(name string) error {
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(exampleConfig)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
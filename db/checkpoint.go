@@ -0,0 +1,131 @@
+package db
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/binary"
+	gohash "hash"
+	"io"
+)
+
+// CheckpointRecord is appended after each index and when a vault that has
+// been written to is closed, so that a vault which doesn't end with one can
+// be recognized as truncated or not cleanly closed.
+type CheckpointRecord struct {
+	// Records is the number of records before the checkpoint
+	Records int64
+	// Hash is the SHA-256 hash of the previous checkpoint's hash followed by
+	// the records after it, as stored in the file
+	Hash []byte
+}
+
+// checkpointer keeps the record count and hash of the records read or
+// written since the last checkpoint.
+type checkpointer struct {
+	records int64
+	since   int
+	hash    gohash.Hash
+	// valid is false when the records before the first one seen are
+	// unknown, as when the vault was opened from an index
+	valid bool
+	// seen is true once a checkpoint record has been seen
+	seen bool
+	// last and lastRecords are the hash and count before the last
+	// checkpoint record added
+	last        []byte
+	lastRecords int64
+}
+
+func newCheckpointer(valid bool) checkpointer {
+	return checkpointer{hash: sha256.New(), valid: valid}
+}
+
+// add accounts for a record as stored in the file.
+func (c *checkpointer) add(hdr Header, data []byte) {
+	if hdr.Type == CheckpointRecordType {
+		c.last, c.lastRecords = c.hash.Sum(nil), c.records
+	}
+	binary.Write(c.hash, binary.LittleEndian, hdr)
+	c.hash.Write(data)
+	c.records++
+	c.since++
+}
+
+// check returns false if rec, the checkpoint record last added, doesn't
+// match the records before it. The following records are then accounted
+// for from rec.
+func (c *checkpointer) check(rec CheckpointRecord) bool {
+	ok := !c.valid || rec.Records == c.lastRecords && bytes.Equal(rec.Hash, c.last)
+	c.reset(rec)
+	return ok
+}
+
+// reset starts accounting for the records after the checkpoint rec.
+func (c *checkpointer) reset(rec CheckpointRecord) {
+	c.records = rec.Records + 1
+	c.since = 0
+	c.hash = sha256.New()
+	c.hash.Write(rec.Hash)
+	c.valid = true
+	c.seen = true
+}
+
+func (c *checkpointer) record() CheckpointRecord {
+	return CheckpointRecord{Records: c.records, Hash: c.hash.Sum(nil)}
+}
+
+// writeCheckpoint appends a checkpoint record. If the records before the
+// index the vault was opened from are unknown they are read first.
+func (db *DB) writeCheckpoint() error {
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	if !db.ck.valid {
+		err := db.rescan()
+		if err != nil {
+			return err
+		}
+	}
+
+	rec := db.ck.record()
+	bs, err := asn1.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	hdr, bs := db.encodeRecord(CheckpointRecordType, db.compressFeature, bs)
+	_, err = appendEncoded(db.fd, hdr, bs)
+	if err != nil {
+		return err
+	}
+	db.ck.reset(rec)
+	return nil
+}
+
+// rescan accounts for every record in the vault.
+func (db *DB) rescan() error {
+	readPtr := db.readPtr
+	defer func() {
+		db.readPtr = readPtr
+		db.tracking = false
+	}()
+
+	db.ck = newCheckpointer(true)
+	db.tracking = true
+	db.rewind()
+	for {
+		rec, err := db.nextRecord(AnyType)
+		if err == io.EOF {
+			return nil
+		}
+		if _, ok := err.(*RecordError); ok {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if cp, ok := rec.(CheckpointRecord); ok {
+			db.ck.check(cp)
+		}
+	}
+}
@@ -0,0 +1,255 @@
+package db
+
+import (
+	"bytes"
+	"encoding/asn1"
+	"encoding/binary"
+	"io"
+)
+
+// CompactResult describes the vault before and after a Compact.
+type CompactResult struct {
+	// SizeBefore and SizeAfter are the file sizes in bytes
+	SizeBefore int64
+	SizeAfter  int64
+	// Records is the number of records read, and Dropped the number of them
+	// not copied as deleted, duplicate or superseded
+	Records int
+	Dropped int
+	// Labels is the number of labels records coalesced into one
+	Labels int
+}
+
+// Compact rewrites the vault to contain only the first message record of
+// each message that has not been deleted, the header records of messages
+// without a body, the label names, an index and a single labels record
+// holding the current labels of every message. The new contents replace
+// the old once they have been completely written.
+func (db *DB) Compact() (CompactResult, error) {
+	defer db.Unlock()
+	db.Lock()
+
+	var res CompactResult
+	if db.readOnly {
+		return res, ErrReadOnly
+	}
+	var err error
+	res.SizeBefore, err = db.fd.Size()
+	if err != nil {
+		return res, err
+	}
+
+	var offsets offsetTable
+	var fhdr FileHeader
+	var ck checkpointer
+	err = db.fd.Rewrite(func(out Storage) error {
+		var err error
+		offsets, fhdr, ck, err = db.compactInto(out, &res)
+		return err
+	})
+	if err != nil {
+		return res, err
+	}
+	db.offsets = offsets
+	db.names.written = len(db.names.names)
+	db.header = fhdr
+	db.ck = ck
+	db.unindexed = 0
+	db.rewind()
+
+	res.SizeAfter, err = db.fd.Size()
+	return res, err
+}
+
+// Dedupe compacts the vault if it holds more than one message record for
+// any message, keeping the first, and returns the number of duplicate
+// records dropped and the result of the compaction.
+func (db *DB) Dedupe() (int, CompactResult, error) {
+	db.Lock()
+	var dups int
+	db.rewind()
+	for {
+		rec, err := db.nextRecord(MessageRecordType)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			db.Unlock()
+			return 0, CompactResult{}, err
+		}
+		msgid := rec.(MessageRecord).MessageID
+		if offset, ok := db.offsets.get(msgid); ok && offset != db.recOffset {
+			dups++
+		}
+	}
+	db.rewind()
+	db.Unlock()
+
+	if dups == 0 {
+		return 0, CompactResult{}, nil
+	}
+	res, err := db.Compact()
+	return dups, res, err
+}
+
+// compactInto writes the compacted vault to out, ending with a checkpoint,
+// returning the offsets of the message records, the file header and the
+// checkpoint state of it. The records read and dropped are counted in res.
+func (db *DB) compactInto(out Storage, res *CompactResult) (offsetTable, FileHeader, checkpointer, error) {
+	// The header is copied, keeping the creation time and watermark, and
+	// rewritten with the index pointer at the end
+	fhdr := db.header
+	fhdr.HavePtr = 0
+	ck := newCheckpointer(true)
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, fhdr)
+	_, err := out.WriteAt(buf.Bytes(), 0)
+	if err != nil {
+		return offsetTable{}, fhdr, ck, err
+	}
+
+	write := func(rtype uint16, features uint16, data []byte) (int64, error) {
+		hdr, bs := db.encodeRecord(rtype, features, data)
+		offset, err := appendEncoded(out, hdr, bs)
+		if err == nil {
+			ck.add(hdr, bs)
+		}
+		return offset, err
+	}
+
+	offsets := newOffsetTable(db.bloomFPRate)
+	headers := make(map[int64]bool)
+	db.rewind()
+	for {
+		// nextRecord verifies the hash of each message as it's read
+		rec, err := db.nextRecord(AnyType)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return offsetTable{}, fhdr, ck, err
+		}
+		// Records copied are uncounted again below
+		res.Records++
+		res.Dropped++
+
+		switch trec := rec.(type) {
+		case MessageRecord:
+			if offset, _ := db.offsets.get(trec.MessageID); offset != db.recOffset {
+				// Deleted, or a duplicate of an earlier copy
+				continue
+			}
+			bs, err := asn1.Marshal(trec)
+			if err != nil {
+				return offsetTable{}, fhdr, ck, err
+			}
+			offset, err := write(MessageRecordType, db.compressFeature|db.hashFeature, bs)
+			if err != nil {
+				return offsetTable{}, fhdr, ck, err
+			}
+			offsets.set(trec.MessageID, offset)
+			res.Dropped--
+
+		case HeaderRecord:
+			if !db.haveHeader[trec.MessageID] || db.have(trec.MessageID) || headers[trec.MessageID] {
+				continue
+			}
+			bs, err := asn1.Marshal(trec)
+			if err != nil {
+				return offsetTable{}, fhdr, ck, err
+			}
+			_, err = write(HeaderRecordType, db.compressFeature|db.hashFeature, bs)
+			if err != nil {
+				return offsetTable{}, fhdr, ck, err
+			}
+			headers[trec.MessageID] = true
+			res.Dropped--
+
+		case LabelsRecord:
+			res.Labels++
+		}
+	}
+
+	var lbls LabelsRecord
+	for msgid, labels := range db.labels {
+		if len(labels) > 0 || len(db.flags[msgid]) > 0 {
+			lbls = append(lbls, LabelsEntry{MessageID: msgid, LabelIDs: db.names.idsOf(labels), Flags: stringSliceToBytes(db.flags[msgid])})
+		}
+	}
+	for msgid, flags := range db.flags {
+		if _, ok := db.labels[msgid]; !ok && len(flags) > 0 {
+			lbls = append(lbls, LabelsEntry{MessageID: msgid, Flags: stringSliceToBytes(flags)})
+		}
+	}
+	idx := db.index(&offsets)
+
+	// The label names are followed by the index and offsets, as written by
+	// WriteIndex, and then the labels record, for opening without the index
+	bs, err := asn1.Marshal(db.names.since(0))
+	if err != nil {
+		return offsetTable{}, fhdr, ck, err
+	}
+	offset, err := write(LabelNamesRecordType, db.compressFeature, bs)
+	if err != nil {
+		return offsetTable{}, fhdr, ck, err
+	}
+	bs, err = asn1.Marshal(idx)
+	if err != nil {
+		return offsetTable{}, fhdr, ck, err
+	}
+	_, err = write(IndexRecordType, db.compressFeature|db.hashFeature, bs)
+	if err != nil {
+		return offsetTable{}, fhdr, ck, err
+	}
+	if offsets.bloom != nil {
+		bs, err = asn1.Marshal(offsets.record())
+		if err != nil {
+			return offsetTable{}, fhdr, ck, err
+		}
+		_, err = write(OffsetsRecordType, db.compressFeature|db.hashFeature, bs)
+		if err != nil {
+			return offsetTable{}, fhdr, ck, err
+		}
+	}
+	if len(lbls) > 0 {
+		bs, err := asn1.Marshal(lbls)
+		if err != nil {
+			return offsetTable{}, fhdr, ck, err
+		}
+		_, err = write(LabelsRecordType, db.compressFeature, bs)
+		if err != nil {
+			return offsetTable{}, fhdr, ck, err
+		}
+	}
+	fhdr.HavePtr = uint64(offset)
+
+	if len(db.scan.Ranges) > 0 {
+		bs, err = asn1.Marshal(db.scan)
+		if err != nil {
+			return offsetTable{}, fhdr, ck, err
+		}
+		_, err = write(ScanRecordType, db.compressFeature, bs)
+		if err != nil {
+			return offsetTable{}, fhdr, ck, err
+		}
+	}
+
+	cp := ck.record()
+	bs, err = asn1.Marshal(cp)
+	if err != nil {
+		return offsetTable{}, fhdr, ck, err
+	}
+	_, err = write(CheckpointRecordType, db.compressFeature, bs)
+	if err != nil {
+		return offsetTable{}, fhdr, ck, err
+	}
+	ck.reset(cp)
+
+	buf.Reset()
+	binary.Write(&buf, binary.LittleEndian, fhdr)
+	_, err = out.WriteAt(buf.Bytes(), 0)
+	if err != nil {
+		return offsetTable{}, fhdr, ck, err
+	}
+	return offsets, fhdr, ck, out.Sync()
+}
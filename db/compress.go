@@ -0,0 +1,57 @@
+package db
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+var (
+	zstdOnce sync.Once
+	zstdEnc  *zstd.Encoder
+	zstdDec  *zstd.Decoder
+)
+
+// The zstd encoder and decoder are safe for concurrent use with EncodeAll
+// and DecodeAll, so one of each is shared.
+func initZstd() {
+	zstdEnc, _ = zstd.NewWriter(nil)
+	zstdDec, _ = zstd.NewReader(nil)
+}
+
+// compress compresses bs according to the feature bits. Data is returned
+// as is when no compression bit is set.
+func compress(features uint16, bs []byte) []byte {
+	switch {
+	case features&FeatureZstd != 0:
+		zstdOnce.Do(initZstd)
+		return zstdEnc.EncodeAll(bs, nil)
+
+	case features&FeatureCompressed != 0:
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		gz.Write(bs)
+		gz.Close()
+		return buf.Bytes()
+	}
+	return bs
+}
+
+func decompress(features uint16, bs []byte) ([]byte, error) {
+	switch {
+	case features&FeatureZstd != 0:
+		zstdOnce.Do(initZstd)
+		return zstdDec.DecodeAll(bs, nil)
+
+	case features&FeatureCompressed != 0:
+		gz, err := gzip.NewReader(bytes.NewBuffer(bs))
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.ReadAll(gz)
+	}
+	return bs, nil
+}
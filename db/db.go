@@ -2,16 +2,15 @@ package db
 
 import (
 	"bytes"
-	"compress/gzip"
+	"crypto/cipher"
 	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/asn1"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
-	"os"
 	"sync"
 	"time"
 )
@@ -25,19 +24,66 @@ const (
 	LabelsRecordType
 	DeleteRecordType
 	HaveRecordType
+	HeaderRecordType
+	IndexRecordType
+	CheckpointRecordType
+	ScanRecordType
+	LabelNamesRecordType
+	OffsetsRecordType
 )
 
 type DB struct {
 	sync.Mutex
-	labels        map[int64][]string
-	labelsChanged map[int64]bool
-	haveMsgID     map[int64]bool
-	fd            *os.File
+	labels          map[int64][]string
+	flags           map[int64][]string
+	labelsChanged   map[int64]bool
+	haveHeader      map[int64]bool
+	fd              Storage
+	header          FileHeader
+	hashFeature     uint16
+	compressFeature uint16
+	// minCompressRatio is the least ratio of uncompressed to compressed
+	// size for which data is stored compressed
+	minCompressRatio float64
+	// readPtr is the offset of the next record to read. Records are read
+	// with ReadAt so that reading doesn't disturb the appending writers.
+	readPtr int64
+	// recOffset and recFeatures are the offset and feature bits of the
+	// record last returned by nextRecord
+	recOffset   int64
+	recFeatures uint16
+	// offsets maps message IDs to the offset of their message record,
+	// behind a Bloom filter with the false positive rate bloomFPRate if
+	// that is set
+	offsets     offsetTable
+	bloomFPRate float64
+	// unindexed is the number of message and header records after the
+	// last index record
+	unindexed int
+	// aead encrypts new records and decrypts encrypted ones, if a key is
+	// set
+	aead cipher.AEAD
+	// names maps label IDs to names and pools the label and flag strings
+	names labelNames
+	// labelsMut serializes WriteLabels, which encodes the record without
+	// holding the main lock
+	labelsMut sync.Mutex
+	// scan is the latest scan record
+	scan ScanRecord
+	// ck accounts for the records since the last checkpoint. Records read
+	// are added to it while tracking is set.
+	ck       checkpointer
+	tracking bool
+	// readOnly is set for vaults opened by OpenReadOnly
+	readOnly bool
 }
 
 const (
 	FeatureCompressed = 1 << iota
 	FeatureHashed
+	FeatureHashed256
+	FeatureZstd
+	FeatureEncrypted
 )
 
 type Header struct {
@@ -49,17 +95,50 @@ type Header struct {
 type MessageRecord struct {
 	MessageID int64
 	Data      []byte
+	// ThreadID is absent from records written before it was added
+	ThreadID int64 `asn1:"optional"`
+}
+
+// HeaderRecord holds only the headers of a message whose body has not been
+// fetched.
+type HeaderRecord struct {
+	MessageID int64
+	Size      int64
+	Header    []byte
 }
 
 type LabelsRecord []LabelsEntry
 
+// DeleteRecord lists messages that are no longer present on the server.
+type DeleteRecord []int64
+
 type LabelsEntry struct {
 	MessageID int64
-	Labels    [][]byte
+	// Labels are the label names in entries written before labels were
+	// interned, and empty in those using LabelIDs
+	Labels [][]byte
+	// Flags are the IMAP flags of the message, absent in entries written
+	// before flags were recorded
+	Flags [][]byte `asn1:"optional"`
+	// LabelIDs refer to the names given by LabelNamesRecords
+	LabelIDs []int64 `asn1:"optional,tag:0"`
 }
 
 const fileMagic = 0x20121025
 
+// FileVersion is the version of the file format written by this package.
+// Older vaults are upgraded by the migrations when opened; newer ones are
+// refused.
+const FileVersion = 2
+
+// migrations[v] upgrades an opened vault from version v to v+1.
+var migrations = map[uint8]func(db *DB) error{
+	// Version 2 refers to labels by ID. The old records stay readable,
+	// the version only keeps older binaries from reading the new ones as
+	// unlabeled.
+	1: func(db *DB) error { return nil },
+}
+
 var fileHeaderLength = binary.Size(FileHeader{})
 
 type FileHeader struct {
@@ -70,64 +149,288 @@ type FileHeader struct {
 	CreateTime uint32
 	UpdateTime uint32
 	HavePtr    uint64
-	Reserved2  uint64
-	Reserved3  uint64
+	// UIDValidity and LastUID record how far the mailbox has been
+	// scanned, so that the next fetch can resume from there.
+	UIDValidity uint32
+	LastUID     uint32
+	// KeySalt is the salt for deriving the encryption key, or zero if no
+	// key has been set.
+	KeySalt uint64
 }
 
+// ErrReadOnly is returned by the writes to a vault opened by OpenReadOnly.
+var ErrReadOnly = errors.New("Vault is opened read-only")
+
 func Open(name string) (*DB, error) {
-	var db DB
-	var err error
+	return OpenKey(name, "")
+}
 
-	db.labels = make(map[int64][]string)
-	db.labelsChanged = make(map[int64]bool)
-	db.haveMsgID = make(map[int64]bool)
+// OpenKey is like Open, but records are encrypted with a key derived from
+// passphrase. Unencrypted records remain readable. Opening fails if the
+// vault contains encrypted records and the passphrase is wrong or empty.
+func OpenKey(name string, passphrase string) (*DB, error) {
+	return OpenWithOptions(name, Options{Passphrase: passphrase})
+}
+
+// OpenStorage is like OpenKey, but the vault is kept in s instead of a file.
+// Closing the vault closes s.
+func OpenStorage(s Storage, passphrase string) (*DB, error) {
+	return OpenStorageWithOptions(s, Options{Passphrase: passphrase})
+}
+
+// OpenReadOnly opens the existing vault name for reading, such as for an
+// export while a fetch appends to it. Nothing is written to the file: a
+// record cut short at the end is taken as the end of the vault rather than
+// removed, an older version is read without upgrading it, and writes fail.
+func OpenReadOnly(name string, passphrase string) (*DB, error) {
+	return OpenWithOptions(name, Options{Passphrase: passphrase, ReadOnly: true})
+}
+
+// OpenStorageReadOnly is like OpenReadOnly, but the vault is kept in s
+// instead of a file.
+func OpenStorageReadOnly(s Storage, passphrase string) (*DB, error) {
+	return OpenStorageWithOptions(s, Options{Passphrase: passphrase, ReadOnly: true})
+}
 
-	f, err := os.OpenFile(name, os.O_CREATE|os.O_RDWR, 0666)
+// Options are the settings for opening a vault with OpenWithOptions.
+type Options struct {
+	// Passphrase is the passphrase of OpenKey, if not empty
+	Passphrase string
+	// ReadOnly opens the vault as OpenReadOnly does
+	ReadOnly bool
+	// BloomFPRate, if not zero, keeps the set of messages in a table sorted
+	// by message ID behind a Bloom filter with this false positive rate,
+	// such as 0.01, instead of a map. The table takes less than half the
+	// memory of the map, which matters for vaults of millions of messages,
+	// at the cost of a binary search for each message looked up that the
+	// filter might have. It is loaded as a whole from the last index if
+	// that was written with a filter, and built from the index entries
+	// otherwise; the map is never built. Lookups remain exact.
+	BloomFPRate float64
+}
+
+// OpenWithOptions opens the vault name with the given options, creating it
+// unless it is opened read-only.
+func OpenWithOptions(name string, opts Options) (*DB, error) {
+	if err := opts.check(); err != nil {
+		return nil, err
+	}
+	open := OpenFile
+	if opts.ReadOnly {
+		open = OpenFileReadOnly
+	}
+	s, err := open(name)
 	if err != nil {
 		return nil, err
 	}
+	db, err := OpenStorageWithOptions(s, opts)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// OpenStorageWithOptions is like OpenWithOptions, but the vault is kept in
+// s instead of a file.
+func OpenStorageWithOptions(s Storage, opts Options) (*DB, error) {
+	if err := opts.check(); err != nil {
+		return nil, err
+	}
+	return openStorage(s, opts)
+}
+
+func (opts Options) check() error {
+	if opts.BloomFPRate != 0 && !(opts.BloomFPRate > 0 && opts.BloomFPRate < 1) {
+		return errors.New("False positive rate must be between 0 and 1")
+	}
+	return nil
+}
+
+func openStorage(s Storage, opts Options) (*DB, error) {
+	var db DB
+	var err error
 
-	db.fd = f
+	passphrase, readOnly := opts.Passphrase, opts.ReadOnly
+	db.bloomFPRate = opts.BloomFPRate
+	db.reset()
+	db.readOnly = readOnly
+	db.hashFeature = FeatureHashed
+	db.compressFeature = FeatureCompressed
+	db.minCompressRatio = 1
+	db.fd = s
 
 	var fhdr FileHeader
-	if stat, err := f.Stat(); err == nil && stat.Size() == 0 {
+	if size, err := s.Size(); err == nil && size == 0 {
 		// New file, write magic
 		fhdr = FileHeader{
 			Magic:      fileMagic,
-			Version:    1,
+			Version:    FileVersion,
 			CreateTime: uint32(time.Now().Unix()),
 		}
-		binary.Write(db.fd, binary.LittleEndian, fhdr)
+		db.header = fhdr
+		if !readOnly {
+			err = db.writeHeader()
+			if err != nil {
+				return nil, err
+			}
+		}
 	} else {
-		binary.Read(db.fd, binary.LittleEndian, &fhdr)
+		binary.Read(io.NewSectionReader(s, 0, int64(fileHeaderLength)), binary.LittleEndian, &fhdr)
 		if fhdr.Magic != fileMagic {
 			return nil, errors.New("Incorrect file format")
 		}
+		if fhdr.Version > FileVersion {
+			return nil, fmt.Errorf("Vault is version %d, newer than the supported version %d", fhdr.Version, FileVersion)
+		}
 	}
 
+	// Without a salt the vault holds no encrypted records, so one is only
+	// set for writing
+	if passphrase != "" && (fhdr.KeySalt != 0 || !readOnly) {
+		if fhdr.KeySalt == 0 {
+			fhdr.KeySalt, err = newSalt()
+			if err != nil {
+				return nil, err
+			}
+			db.header = fhdr
+			err = db.writeHeader()
+			if err != nil {
+				return nil, err
+			}
+		}
+		db.aead, err = newCipher(passphrase, fhdr.KeySalt)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	db.rewind()
+	db.ck = newCheckpointer(true)
+	if fhdr.HavePtr != 0 {
+		err := db.readIndex(int64(fhdr.HavePtr))
+		if err != nil {
+			log.Printf("Ignoring index: %v", err)
+			db.reset()
+			db.rewind()
+		} else {
+			db.ck = newCheckpointer(false)
+		}
+	}
+	db.tracking = true
+	decrypted := false
 	for {
 		rec, err := db.nextRecord(AnyType)
 		if err == io.EOF {
 			break
 		}
+		if rerr, ok := err.(*RecordError); ok {
+			switch {
+			case rerr.Err == errNoKey:
+				return nil, errors.New("Vault is encrypted; no key given")
+			case rerr.Err == errDecrypt && !decrypted:
+				return nil, errors.New("Incorrect encryption key")
+			}
+			log.Printf("Skipping %v", err)
+			continue
+		}
+		if _, ok := err.(*truncatedError); ok && readOnly {
+			// The record may be still being appended by a writer
+			break
+		}
+		if terr, ok := err.(*truncatedError); ok {
+			// Drop the partial record so that new records are
+			// appended after the last complete one.
+			log.Printf("Removing %v", err)
+			err = s.Truncate(terr.offset)
+			if err != nil {
+				return nil, err
+			}
+			break
+		}
 		if err != nil {
 			return nil, err
 		}
 
+		if db.aead != nil && db.recFeatures&FeatureEncrypted != 0 {
+			decrypted = true
+		}
+
 		switch trec := rec.(type) {
 		case MessageRecord:
-			db.haveMsgID[trec.MessageID] = true
+			if db.have(trec.MessageID) {
+				// A duplicate; the first copy is the one used
+				continue
+			}
+			db.offsets.set(trec.MessageID, db.recOffset)
+			db.unindexed++
+		case HeaderRecord:
+			db.haveHeader[trec.MessageID] = true
+			db.unindexed++
+		case LabelNamesRecord:
+			db.names.add(trec)
 		case LabelsRecord:
 			for _, lrec := range trec {
-				db.labels[lrec.MessageID] = bytesSliceToStrings(lrec.Labels)
+				labels, err := db.names.labels(lrec.Labels, lrec.LabelIDs)
+				if err != nil {
+					log.Printf("Skipping labels of message %d at offset %d: %v", lrec.MessageID, db.recOffset, err)
+					continue
+				}
+				db.labels[lrec.MessageID] = labels
+				if len(lrec.Flags) > 0 {
+					db.flags[lrec.MessageID] = db.names.internBytes(lrec.Flags)
+				} else {
+					delete(db.flags, lrec.MessageID)
+				}
+			}
+		case DeleteRecord:
+			for _, msgid := range trec {
+				db.forget(msgid)
+			}
+		case ScanRecord:
+			db.scan = trec
+		case CheckpointRecord:
+			if !db.ck.check(trec) {
+				log.Printf("Checkpoint at offset %d does not match the records before it", db.recOffset)
 			}
 		}
 	}
+	db.tracking = false
 
-	db.Rewind()
+	db.header = fhdr
+	// The upgrades so far leave the records readable as they are
+	for !readOnly && db.header.Version < FileVersion {
+		migrate := migrations[db.header.Version]
+		if migrate == nil {
+			return nil, fmt.Errorf("Cannot upgrade vault from version %d", db.header.Version)
+		}
+		log.Printf("Upgrading vault from version %d", db.header.Version)
+		err = migrate(&db)
+		if err != nil {
+			return nil, err
+		}
+		db.header.Version++
+		err = db.writeHeader()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	db.rewind()
 	return &db, nil
 }
 
+func (db *DB) reset() {
+	db.labels = make(map[int64][]string)
+	db.flags = make(map[int64][]string)
+	db.labelsChanged = make(map[int64]bool)
+	db.haveHeader = make(map[int64]bool)
+	db.offsets = newOffsetTable(db.bloomFPRate)
+	db.names = newLabelNames()
+	db.scan = ScanRecord{}
+	db.unindexed = 0
+}
+
 func stringSliceToBytes(ss []string) [][]byte {
 	var res [][]byte
 	for _, s := range ss {
@@ -136,28 +439,203 @@ func stringSliceToBytes(ss []string) [][]byte {
 	return res
 }
 
-func bytesSliceToStrings(bs [][]byte) []string {
-	var res []string
-	for _, b := range bs {
-		res = append(res, string(b))
+// SetHash selects the hash algorithm, "sha1" or "sha256", for records
+// written from now on, or "none" to write them without a hash, trading the
+// detection of corrupted records for speed. Existing records are verified
+// using the algorithm they were written with.
+func (db *DB) SetHash(algo string) error {
+	defer db.Unlock()
+	db.Lock()
+	switch algo {
+	case "sha1":
+		db.hashFeature = FeatureHashed
+	case "sha256":
+		db.hashFeature = FeatureHashed256
+	case "none":
+		db.hashFeature = 0
+	default:
+		return errors.New("Unknown hash algorithm " + algo)
 	}
-	return res
+	return nil
+}
+
+// SetCompression selects the compression, "gzip", "zstd" or "none", for
+// records written from now on. Existing records are decompressed according
+// to how they were written.
+func (db *DB) SetCompression(algo string) error {
+	defer db.Unlock()
+	db.Lock()
+	switch algo {
+	case "gzip":
+		db.compressFeature = FeatureCompressed
+	case "zstd":
+		db.compressFeature = FeatureZstd
+	case "none":
+		db.compressFeature = 0
+	default:
+		return errors.New("Unknown compression " + algo)
+	}
+	return nil
+}
+
+// SetMinCompressRatio sets the least ratio of uncompressed to compressed
+// size for which records written from now on are stored compressed. Data
+// that compresses less, such as messages consisting mostly of compressed
+// attachments, is stored as is. The default of 1 stores data compressed
+// whenever that makes it smaller.
+func (db *DB) SetMinCompressRatio(ratio float64) error {
+	defer db.Unlock()
+	db.Lock()
+	if !(ratio >= 1) {
+		return errors.New("Minimum compression ratio must be at least 1")
+	}
+	db.minCompressRatio = ratio
+	return nil
+}
+
+// Close writes a checkpoint if records have been added since the last one,
+// unless the vault is read-only, and closes the file.
+func (db *DB) Close() error {
+	defer db.Unlock()
+	db.Lock()
+	if !db.readOnly && (db.ck.since > 0 || !db.ck.valid) {
+		err := db.writeCheckpoint()
+		if err != nil {
+			db.fd.Close()
+			return err
+		}
+	}
+	return db.fd.Close()
 }
 
 func (db *DB) Rewind() {
-	db.fd.Seek(int64(fileHeaderLength), os.SEEK_SET)
+	defer db.Unlock()
+	db.Lock()
+	db.rewind()
+}
+
+func (db *DB) rewind() {
+	db.readPtr = int64(fileHeaderLength)
 }
 
 func (db *DB) Size() int {
 	defer db.Unlock()
 	db.Lock()
-	return len(db.haveMsgID)
+	return db.offsets.len()
+}
+
+// Watermark returns the UIDVALIDITY of the synced mailbox and the highest
+// UID that has been completely synced.
+func (db *DB) Watermark() (validity, uid uint32) {
+	defer db.Unlock()
+	db.Lock()
+	return db.header.UIDValidity, db.header.LastUID
+}
+
+func (db *DB) SetWatermark(validity, uid uint32) error {
+	defer db.Unlock()
+	db.Lock()
+	db.header.UIDValidity = validity
+	db.header.LastUID = uid
+	return db.writeHeader()
+}
+
+// LastUpdated returns the time of the last successful sync, or the zero time
+// if there has been none.
+func (db *DB) LastUpdated() time.Time {
+	defer db.Unlock()
+	db.Lock()
+	if db.header.UpdateTime == 0 {
+		return time.Time{}
+	}
+	return time.Unix(int64(db.header.UpdateTime), 0)
+}
+
+// SetUpdated records the current time as the time of the last successful
+// sync.
+func (db *DB) SetUpdated() error {
+	defer db.Unlock()
+	db.Lock()
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	db.header.UpdateTime = uint32(time.Now().Unix())
+
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], db.header.UpdateTime)
+	_, err := db.fd.WriteAt(buf[:], updateTimeOffset)
+	if err != nil {
+		return err
+	}
+	return db.fd.Sync()
+}
+
+// updateTimeOffset is the offset of UpdateTime in the file header
+const updateTimeOffset = 12
+
+func (db *DB) writeHeader() error {
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, db.header)
+	_, err := db.fd.WriteAt(buf.Bytes(), 0)
+	if err != nil {
+		return err
+	}
+	return db.fd.Sync()
 }
 
 func (db *DB) HaveUID(msgid int64) bool {
 	defer db.Unlock()
 	db.Lock()
-	return db.haveMsgID[msgid]
+	return db.have(msgid)
+}
+
+// have returns true if there is a message record for the message. The
+// offsets table doubles as the set of messages, rather than keeping a
+// separate one, which matters for the memory use of large vaults.
+func (db *DB) have(msgid int64) bool {
+	_, ok := db.offsets.get(msgid)
+	return ok
+}
+
+// HaveHeader returns true if there is a header record for the message.
+func (db *DB) HaveHeader(msgid int64) bool {
+	defer db.Unlock()
+	db.Lock()
+	return db.haveHeader[msgid]
+}
+
+// HeaderOnly returns the IDs of the messages stored headers only, whose
+// bodies are still to be fetched.
+func (db *DB) HeaderOnly() []int64 {
+	defer db.Unlock()
+	db.Lock()
+	var res []int64
+	for msgid := range db.haveHeader {
+		if !db.have(msgid) {
+			res = append(res, msgid)
+		}
+	}
+	return res
+}
+
+// MessageIDs returns the IDs of all messages in the vault, including those
+// stored headers only.
+func (db *DB) MessageIDs() []int64 {
+	defer db.Unlock()
+	db.Lock()
+	var res []int64
+	db.offsets.each(func(msgid, _ int64) {
+		res = append(res, msgid)
+	})
+	for msgid := range db.haveHeader {
+		if !db.have(msgid) {
+			res = append(res, msgid)
+		}
+	}
+	return res
 }
 
 func (db *DB) Labels(msgid int64) []string {
@@ -169,151 +647,482 @@ func (db *DB) Labels(msgid int64) []string {
 func (db *DB) SetLabels(msgid int64, labels []string) {
 	defer db.Unlock()
 	db.Lock()
-	db.labels[msgid] = labels
+	db.labels[msgid] = db.names.internStrings(labels)
+	db.labelsChanged[msgid] = true
+}
+
+// Flags returns the IMAP flags of the message, such as \Seen and \Flagged.
+func (db *DB) Flags(msgid int64) []string {
+	defer db.Unlock()
+	db.Lock()
+	return db.flags[msgid]
+}
+
+// SetFlags sets the IMAP flags of the message, which are written along with
+// its labels by WriteLabels.
+func (db *DB) SetFlags(msgid int64, flags []string) {
+	defer db.Unlock()
+	db.Lock()
+	db.flags[msgid] = db.names.internStrings(flags)
 	db.labelsChanged[msgid] = true
 }
 
+// WriteMessage appends a message record, unless the vault already holds
+// the message.
 func (db *DB) WriteMessage(msgid int64, data []byte) error {
-	rec := MessageRecord{MessageID: msgid, Data: data}
+	return db.WriteMessageRecord(MessageRecord{MessageID: msgid, Data: data})
+}
+
+// WriteMessageRecord is like WriteMessage but takes the complete record.
+func (db *DB) WriteMessageRecord(rec MessageRecord) error {
+	msgid := rec.MessageID
 	bs, err := asn1.Marshal(rec)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
+	db.Lock()
+	enc := db.encoder()
+	db.Unlock()
+	hdr, bs := enc.encodeRecord(MessageRecordType, enc.compressFeature|enc.hashFeature, bs)
+
 	defer db.Unlock()
 	db.Lock()
 
-	return db.writeRecord(MessageRecordType, FeatureCompressed|FeatureHashed, bs)
+	if db.have(msgid) {
+		return nil
+	}
+	offset, err := db.append(hdr, bs)
+	if err == nil {
+		db.offsets.set(msgid, offset)
+		db.unindexed++
+	}
+	return err
 }
 
-func (db *DB) ReadMessage() (*MessageRecord, error) {
-	intf, err := db.nextRecord(MessageRecordType)
+// WriteHeaderRecord appends a header record with the headers and size of a
+// message whose body isn't fetched, unless the vault already holds one.
+func (db *DB) WriteHeaderRecord(msgid int64, size int64, header []byte) error {
+	rec := HeaderRecord{MessageID: msgid, Size: size, Header: header}
+	bs, err := asn1.Marshal(rec)
 	if err != nil {
-		return nil, err
+		return err
+	}
+
+	db.Lock()
+	enc := db.encoder()
+	db.Unlock()
+	hdr, bs := enc.encodeRecord(HeaderRecordType, enc.compressFeature|enc.hashFeature, bs)
+
+	defer db.Unlock()
+	db.Lock()
+
+	if db.haveHeader[msgid] {
+		return nil
 	}
-	rec := intf.(MessageRecord)
-	return &rec, nil
+	_, err = db.append(hdr, bs)
+	if err == nil {
+		db.haveHeader[msgid] = true
+		db.unindexed++
+	}
+	return err
 }
 
+// ReadMessage returns the next message record, skipping messages that have
+// been deleted and duplicate copies of a message. A record cut short at the
+// end of the vault, such as one still being appended by another writer,
+// ends the messages as io.EOF; it is read by a later call once complete.
+func (db *DB) ReadMessage() (*MessageRecord, error) {
+	defer db.Unlock()
+	db.Lock()
+	for {
+		intf, err := db.nextRecord(MessageRecordType)
+		if _, ok := err.(*truncatedError); ok {
+			return nil, io.EOF
+		}
+		if err != nil {
+			return nil, err
+		}
+		rec := intf.(MessageRecord)
+		if offset, ok := db.offsets.get(rec.MessageID); ok && offset == db.recOffset {
+			return &rec, nil
+		}
+	}
+}
+
+// Iterate calls fn for every record of the given type, or all records for
+// AnyType, from the start of the vault. Records are passed as MessageRecord,
+// LabelsRecord, DeleteRecord, HeaderRecord, IndexRecord, CheckpointRecord,
+// ScanRecord, LabelNamesRecord or OffsetsRecord values. Iteration stops at
+// the first error returned by fn, which is then returned by Iterate, and at
+// a record cut short at the end of the vault, as ReadMessage does.
+func (db *DB) Iterate(recordType uint16, fn func(interface{}) error) error {
+	db.Rewind()
+	for {
+		db.Lock()
+		rec, err := db.nextRecord(recordType)
+		db.Unlock()
+		if _, ok := err.(*truncatedError); ok || err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		err = fn(rec)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// WriteLabels appends the labels and flags set since the last call, if any.
 func (db *DB) WriteLabels() error {
 	var lbls LabelsRecord
 
-	defer db.Unlock()
-	db.Lock()
+	// Later labels records supersede earlier ones, so they must be
+	// appended in the order the changes were collected
+	defer db.labelsMut.Unlock()
+	db.labelsMut.Lock()
 
+	db.Lock()
 	for msgid := range db.labelsChanged {
-		rec := LabelsEntry{MessageID: msgid, Labels: stringSliceToBytes(db.labels[msgid])}
+		rec := LabelsEntry{MessageID: msgid, LabelIDs: db.names.idsOf(db.labels[msgid]), Flags: stringSliceToBytes(db.flags[msgid])}
 		lbls = append(lbls, rec)
 	}
 	db.labelsChanged = make(map[int64]bool)
+	// The names of new label IDs are written before the labels using them
+	names := db.names.since(db.names.written)
+	enc := db.encoder()
+	db.Unlock()
+	if len(lbls) == 0 && len(names.Names) == 0 {
+		return nil
+	}
 
 	bs, err := asn1.Marshal(lbls)
 	if err != nil {
-		panic(err)
+		return err
 	}
+	hdr, bs := enc.encodeRecord(LabelsRecordType, enc.compressFeature, bs)
+	var nhdr Header
+	var nbs []byte
+	if len(names.Names) > 0 {
+		nbs, err = asn1.Marshal(names)
+		if err != nil {
+			return err
+		}
+		nhdr, nbs = enc.encodeRecord(LabelNamesRecordType, enc.compressFeature, nbs)
+	}
+
+	defer db.Unlock()
+	db.Lock()
 
-	return db.writeRecord(LabelsRecordType, FeatureCompressed, bs)
+	if len(names.Names) > 0 {
+		_, err = db.append(nhdr, nbs)
+		if err != nil {
+			return err
+		}
+		db.names.wrote(names)
+	}
+	_, err = db.append(hdr, bs)
+	return err
+}
+
+// WriteDelete records that the given messages have been removed from the
+// server. They are no longer returned by ReadMessage, and are dropped from
+// the file by Compact.
+func (db *DB) WriteDelete(msgids []int64) error {
+	bs, err := asn1.Marshal(DeleteRecord(msgids))
+	if err != nil {
+		return err
+	}
+
+	defer db.Unlock()
+	db.Lock()
+
+	_, err = db.writeRecord(DeleteRecordType, db.compressFeature, bs)
+	if err != nil {
+		return err
+	}
+	for _, msgid := range msgids {
+		db.forget(msgid)
+	}
+	return nil
+}
+
+func (db *DB) forget(msgid int64) {
+	delete(db.haveHeader, msgid)
+	db.offsets.delete(msgid)
+	delete(db.labels, msgid)
+	delete(db.flags, msgid)
+	delete(db.labelsChanged, msgid)
+}
+
+// RecordError is returned when a record can't be decoded. The read pointer
+// is left after the bad record, so reading may continue with the next one.
+type RecordError struct {
+	Offset int64
+	Err    error
+}
+
+func (e *RecordError) Error() string {
+	return fmt.Sprintf("corrupt record at offset %d: %v", e.Offset, e.Err)
+}
+
+var errHashMismatch = errors.New("hash mismatch")
+
+// truncatedError is returned when the vault ends in the middle of the
+// record at offset, as happens when a write was interrupted.
+type truncatedError struct {
+	offset int64
+}
+
+func (e *truncatedError) Error() string {
+	return fmt.Sprintf("truncated record at offset %d", e.offset)
 }
 
 func (db *DB) nextRecord(recordType uint16) (interface{}, error) {
 	for {
+		offset := db.readPtr
+		r := io.NewSectionReader(db.fd, offset, 1<<62)
+
 		var hdr Header
-		err := binary.Read(db.fd, binary.LittleEndian, &hdr)
+		err := binary.Read(r, binary.LittleEndian, &hdr)
+		if err == io.ErrUnexpectedEOF {
+			return nil, &truncatedError{offset}
+		}
 		if err != nil {
 			return nil, err
 		}
 
 		if recordType != AnyType && hdr.Type != recordType {
-			db.fd.Seek(int64(hdr.Length), os.SEEK_CUR)
+			db.readPtr += int64(binary.Size(hdr)) + int64(hdr.Length)
 			continue
 		}
 
 		var data = make([]byte, hdr.Length)
-		_, err = db.fd.Read(data)
+		_, err = io.ReadFull(r, data)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, &truncatedError{offset}
+		}
 		if err != nil {
 			return nil, err
 		}
-
-		var dhash []byte
-		if hdr.FeatureBits&FeatureHashed != 0 {
-			dhash = data[:20]
-			data = data[20:]
-		}
-
-		if hdr.FeatureBits&FeatureCompressed != 0 {
-			data = decompress(data)
+		db.readPtr += int64(binary.Size(hdr)) + int64(hdr.Length)
+		if db.tracking {
+			db.ck.add(hdr, data)
 		}
 
-		if hdr.FeatureBits&FeatureHashed != 0 {
-			chash := hash(data)
-			if bytes.Compare(chash, dhash) != 0 {
-				panic("hash failure")
-			}
+		data, err = decodePayload(db.aead, hdr, data)
+		if err != nil {
+			return nil, &RecordError{offset, err}
 		}
+		db.recOffset = offset
+		db.recFeatures = hdr.FeatureBits
 
 		switch hdr.Type {
 		case MessageRecordType:
 			var msg MessageRecord
 			_, err := asn1.Unmarshal(data, &msg)
 			if err != nil {
-				panic(err)
+				return nil, &RecordError{offset, err}
 			}
-			return msg, err
+			return msg, nil
 
 		case LabelsRecordType:
 			var lbl LabelsRecord
 			_, err := asn1.Unmarshal(data, &lbl)
 			if err != nil {
-				panic(err)
+				return nil, &RecordError{offset, err}
+			}
+			return lbl, nil
+
+		case DeleteRecordType:
+			var del DeleteRecord
+			_, err := asn1.Unmarshal(data, &del)
+			if err != nil {
+				return nil, &RecordError{offset, err}
+			}
+			return del, nil
+
+		case HeaderRecordType:
+			var hdr HeaderRecord
+			_, err := asn1.Unmarshal(data, &hdr)
+			if err != nil {
+				return nil, &RecordError{offset, err}
+			}
+			return hdr, nil
+
+		case IndexRecordType:
+			var idx IndexRecord
+			_, err := asn1.Unmarshal(data, &idx)
+			if err != nil {
+				return nil, &RecordError{offset, err}
+			}
+			return idx, nil
+
+		case CheckpointRecordType:
+			var cp CheckpointRecord
+			_, err := asn1.Unmarshal(data, &cp)
+			if err != nil {
+				return nil, &RecordError{offset, err}
+			}
+			return cp, nil
+
+		case ScanRecordType:
+			var scan ScanRecord
+			_, err := asn1.Unmarshal(data, &scan)
+			if err != nil {
+				return nil, &RecordError{offset, err}
+			}
+			return scan, nil
+
+		case LabelNamesRecordType:
+			var names LabelNamesRecord
+			_, err := asn1.Unmarshal(data, &names)
+			if err != nil {
+				return nil, &RecordError{offset, err}
 			}
-			return lbl, err
+			return names, nil
+
+		case OffsetsRecordType:
+			var offs OffsetsRecord
+			_, err := asn1.Unmarshal(data, &offs)
+			if err != nil {
+				return nil, &RecordError{offset, err}
+			}
+			return offs, nil
 		}
 	}
 }
 
-func (db *DB) writeRecord(rtype uint16, features uint16, data []byte) error {
-	var bs []byte
+// decodePayload decrypts, verifies and decompresses the data portion of a
+// record according to its feature bits. On a hash mismatch the decompressed
+// payload is returned along with the error.
+func decodePayload(aead cipher.AEAD, hdr Header, data []byte) ([]byte, error) {
+	if hdr.FeatureBits&FeatureEncrypted != 0 {
+		var err error
+		data, err = decrypt(aead, hdr.Type, data)
+		if err != nil {
+			return nil, err
+		}
+	}
 
-	if features&FeatureHashed != 0 {
-		bs = append(bs, hash(data)...)
+	var dhash []byte
+	if n := hashLen(hdr.FeatureBits); n > 0 {
+		if len(data) < n {
+			return nil, errors.New("record too short for hash")
+		}
+		dhash = data[:n]
+		data = data[n:]
 	}
-	if features&FeatureCompressed != 0 {
-		bs = append(bs, compress(data)...)
-	} else {
-		bs = append(bs, data...)
+
+	data, err := decompress(hdr.FeatureBits, data)
+	if err != nil {
+		return nil, err
 	}
 
-	hdr := Header{rtype, features, uint32(len(bs))}
+	if dhash != nil && !bytes.Equal(hash(hdr.FeatureBits, data), dhash) {
+		return data, errHashMismatch
+	}
+	return data, nil
+}
 
-	db.fd.Seek(0, os.SEEK_END)
-	binary.Write(db.fd, binary.LittleEndian, hdr)
-	db.fd.Write(bs)
-	return db.fd.Sync()
+func (db *DB) writeRecord(rtype uint16, features uint16, data []byte) (int64, error) {
+	hdr, bs := db.encodeRecord(rtype, features, data)
+	return db.append(hdr, bs)
 }
 
-func compress(bs []byte) []byte {
-	var buf bytes.Buffer
-	gz := gzip.NewWriter(&buf)
-	gz.Write(bs)
-	gz.Close()
-	return buf.Bytes()
+// append writes an encoded record at the end of the vault, accounting for
+// it in the next checkpoint.
+func (db *DB) append(hdr Header, bs []byte) (int64, error) {
+	if db.readOnly {
+		return 0, ErrReadOnly
+	}
+	offset, err := appendEncoded(db.fd, hdr, bs)
+	if err == nil {
+		db.ck.add(hdr, bs)
+	}
+	return offset, err
 }
 
-func hash(bs []byte) []byte {
-	ha := sha1.New()
-	ha.Write(bs)
-	return ha.Sum(nil)
+// encoder holds the settings new records are encoded with.
+type encoder struct {
+	hashFeature      uint16
+	compressFeature  uint16
+	minCompressRatio float64
+	aead             cipher.AEAD
 }
 
-func decompress(bs []byte) []byte {
-	gz, err := gzip.NewReader(bytes.NewBuffer(bs))
-	if err != nil {
-		panic(err)
+// encoder returns a copy of the encoding settings, with which records can be
+// encoded without holding the lock. The caller holds the lock.
+func (db *DB) encoder() encoder {
+	return encoder{db.hashFeature, db.compressFeature, db.minCompressRatio, db.aead}
+}
+
+// encodeRecord encodes a record with the current settings. The caller holds
+// the lock.
+func (db *DB) encodeRecord(rtype uint16, features uint16, data []byte) (Header, []byte) {
+	return db.encoder().encodeRecord(rtype, features, data)
+}
+
+// encodeRecord returns the header and the hashed, compressed and possibly
+// encrypted data of a record. The data is stored uncompressed if compressing
+// it doesn't reach the minimum compression ratio.
+func (e encoder) encodeRecord(rtype uint16, features uint16, data []byte) (Header, []byte) {
+	var bs []byte
+
+	bs = append(bs, hash(features, data)...)
+	cbs := compress(features, data)
+	if features&(FeatureCompressed|FeatureZstd) != 0 && (len(cbs) >= len(data) || float64(len(data)) < e.minCompressRatio*float64(len(cbs))) {
+		features &^= FeatureCompressed | FeatureZstd
+		cbs = data
+	}
+	bs = append(bs, cbs...)
+	if e.aead != nil {
+		features |= FeatureEncrypted
+		bs = encrypt(e.aead, rtype, bs)
 	}
 
-	data, err := ioutil.ReadAll(gz)
+	return Header{rtype, features, uint32(len(bs))}, bs
+}
+
+// appendEncoded writes a record encoded by encodeRecord at the end of s,
+// returning its offset.
+func appendEncoded(s Storage, hdr Header, bs []byte) (int64, error) {
+	offset, err := s.Size()
 	if err != nil {
-		panic(err)
+		return 0, err
+	}
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, hdr)
+	buf.Write(bs)
+	_, err = s.WriteAt(buf.Bytes(), offset)
+	if err != nil {
+		return 0, err
+	}
+	return offset, s.Sync()
+}
+
+// hash returns the hash of bs selected by the feature bits, or nil.
+func hash(features uint16, bs []byte) []byte {
+	switch {
+	case features&FeatureHashed256 != 0:
+		sum := sha256.Sum256(bs)
+		return sum[:]
+	case features&FeatureHashed != 0:
+		sum := sha1.Sum(bs)
+		return sum[:]
+	}
+	return nil
+}
+
+func hashLen(features uint16) int {
+	switch {
+	case features&FeatureHashed256 != 0:
+		return sha256.Size
+	case features&FeatureHashed != 0:
+		return sha1.Size
 	}
-	return data
+	return 0
 }
@@ -0,0 +1,382 @@
+package db
+
+import (
+	"bytes"
+	"encoding/asn1"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// testVault returns storage holding a vault with the given messages, with
+// message IDs from 1.
+func testVault(t *testing.T, msgs ...string) *MemoryStorage {
+	t.Helper()
+	var s MemoryStorage
+	db, err := OpenStorage(&s, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, msg := range msgs {
+		err = db.WriteMessage(int64(i+1), []byte(msg))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &s
+}
+
+// readAll returns the data of the messages in db by message ID.
+func readAll(t *testing.T, db *DB) map[int64]string {
+	t.Helper()
+	res := make(map[int64]string)
+	err := db.Iterate(MessageRecordType, func(rec interface{}) error {
+		msg := rec.(MessageRecord)
+		res[msg.MessageID] = string(msg.Data)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+// halfWritten returns the first n bytes of an encoded message record, as
+// left by a write that was interrupted.
+func halfWritten(t *testing.T, db *DB, msgid int64, n int) []byte {
+	t.Helper()
+	bs, err := asn1.Marshal(MessageRecord{MessageID: msgid, Data: []byte("never completed")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hdr, bs := db.encodeRecord(MessageRecordType, FeatureCompressed|FeatureHashed, bs)
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, hdr)
+	buf.Write(bs)
+	return buf.Bytes()[:n]
+}
+
+func TestOpenTruncatedRecord(t *testing.T) {
+	cases := []struct {
+		name string
+		cut  int
+	}{
+		{"header", 5},
+		{"data", 20},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := testVault(t, "one", "two")
+			complete := s.Bytes()
+			db, err := OpenStorage(s, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.WriteAt(halfWritten(t, db, 3, tc.cut), int64(len(complete)))
+			damaged := s.Bytes()
+
+			ro, err := OpenStorageReadOnly(s, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n := ro.Size(); n != 2 {
+				t.Errorf("read-only open found %d messages, not 2", n)
+			}
+			if !bytes.Equal(s.Bytes(), damaged) {
+				t.Error("read-only open changed the vault")
+			}
+
+			db, err = OpenStorage(s, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(s.Bytes(), complete) {
+				t.Errorf("vault is %d bytes after open, not the %d before the partial record", len(s.Bytes()), len(complete))
+			}
+			err = db.WriteMessage(3, []byte("three"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = db.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			db, err = OpenStorage(s, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := readAll(t, db)
+			want := map[int64]string{1: "one", 2: "two", 3: "three"}
+			if len(got) != len(want) {
+				t.Fatalf("read %v, not %v", got, want)
+			}
+			for msgid, data := range want {
+				if got[msgid] != data {
+					t.Errorf("message %d is %q, not %q", msgid, got[msgid], data)
+				}
+			}
+		})
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	s := testVault(t, "one")
+	before := s.Bytes()
+
+	db, err := OpenStorageReadOnly(s, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.WriteMessage(2, []byte("two")); err != ErrReadOnly {
+		t.Errorf("WriteMessage returned %v, not ErrReadOnly", err)
+	}
+	if err := db.SetWatermark(1, 2); err != ErrReadOnly {
+		t.Errorf("SetWatermark returned %v, not ErrReadOnly", err)
+	}
+	if err := db.SetUpdated(); err != ErrReadOnly {
+		t.Errorf("SetUpdated returned %v, not ErrReadOnly", err)
+	}
+	if _, err := db.Compact(); err != ErrReadOnly {
+		t.Errorf("Compact returned %v, not ErrReadOnly", err)
+	}
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(s.Bytes(), before) {
+		t.Error("read-only vault was changed")
+	}
+}
+
+func TestConcurrentReader(t *testing.T) {
+	const n = 200
+	s := testVault(t)
+	w, err := OpenStorage(s, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error)
+	go func() {
+		for i := 1; i <= n; i++ {
+			err := w.WriteMessage(int64(i), []byte(fmt.Sprint("message ", i)))
+			if err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- w.Close()
+	}()
+
+	// Each reader sees the messages written so far, in order
+	check := func() int {
+		r, err := OpenStorageReadOnly(s, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		got := readAll(t, r)
+		for i := 1; i <= len(got); i++ {
+			if want := fmt.Sprint("message ", i); got[int64(i)] != want {
+				t.Fatalf("message %d of %d is %q, not %q", i, len(got), got[int64(i)], want)
+			}
+		}
+		return len(got)
+	}
+	for {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := check(); got != n {
+				t.Errorf("read %d messages, not %d", got, n)
+			}
+			return
+		default:
+			check()
+		}
+	}
+}
+
+func TestWriteLabelsUnchanged(t *testing.T) {
+	s := testVault(t, "one")
+	before := s.Bytes()
+
+	db, err := OpenStorageReadOnly(s, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.WriteLabels()
+	if err != nil {
+		t.Errorf("WriteLabels without changes returned %v", err)
+	}
+	db.SetLabels(1, []string{"Inbox"})
+	if err := db.WriteLabels(); err != ErrReadOnly {
+		t.Errorf("WriteLabels with changes returned %v, not ErrReadOnly", err)
+	}
+	db.Close()
+	if !bytes.Equal(s.Bytes(), before) {
+		t.Error("read-only vault was changed")
+	}
+}
+
+// TestSetCompressionWhileWriting changes the settings while messages are
+// written, which the race detector reports if they are read unlocked.
+func TestSetCompressionWhileWriting(t *testing.T) {
+	const n = 100
+	db, err := OpenStorage(testVault(t), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < n; i++ {
+			db.SetCompression([]string{"gzip", "none"}[i%2])
+			db.SetHash([]string{"sha1", "sha256"}[i%2])
+			db.SetMinCompressRatio(float64(1 + i%2))
+		}
+	}()
+	for i := 1; i <= n; i++ {
+		err := db.WriteMessage(int64(i), bytes.Repeat([]byte("message "), i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		db.SetLabels(int64(i), []string{"Inbox"})
+		err = db.WriteLabels()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-done
+
+	got := readAll(t, db)
+	for i := 1; i <= n; i++ {
+		if want := string(bytes.Repeat([]byte("message "), i)); got[int64(i)] != want {
+			t.Errorf("message %d is %q, not %q", i, got[int64(i)], want)
+		}
+	}
+}
+
+func BenchmarkWriteMessageParallel(b *testing.B) {
+	db, err := OpenStorage(&MemoryStorage{}, "")
+	if err != nil {
+		b.Fatal(err)
+	}
+	data := bytes.Repeat([]byte("Subject: benchmark\r\n\r\nSome text to compress\r\n"), 200)
+	var mut sync.Mutex
+	var next int64
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			mut.Lock()
+			next++
+			msgid := next
+			mut.Unlock()
+			err := db.WriteMessage(msgid, data)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// versionOffset is the offset of Version in the file header
+const versionOffset = 4
+
+func TestOpenVersion(t *testing.T) {
+	s := testVault(t, "one")
+	s.WriteAt([]byte{FileVersion + 1}, versionOffset)
+	if _, err := OpenStorage(s, ""); err == nil {
+		t.Error("vault of a newer version opened")
+	}
+	if _, err := OpenStorageReadOnly(s, ""); err == nil {
+		t.Error("vault of a newer version opened read-only")
+	}
+
+	// Older versions are upgraded when opened for writing
+	s.WriteAt([]byte{1}, versionOffset)
+	db, err := OpenStorageReadOnly(s, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := s.Bytes()[versionOffset]; v != 1 {
+		t.Errorf("read-only open changed the version to %d", v)
+	}
+	db.Close()
+	db, err = OpenStorage(s, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := s.Bytes()[versionOffset]; v != FileVersion {
+		t.Errorf("version is %d after upgrade, not %d", v, FileVersion)
+	}
+	if got := readAll(t, db); got[1] != "one" {
+		t.Errorf("messages after upgrade are %v", got)
+	}
+	db.Close()
+}
+
+func TestWriteHeaderRecord(t *testing.T) {
+	var s MemoryStorage
+	db, err := OpenStorage(&s, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.SetCompression("none")
+	if err != nil {
+		t.Fatal(err)
+	}
+	offset := int64(len(s.Bytes()))
+	header := []byte("Subject: large\r\nFrom: someone@example.com\r\n\r\n")
+	err = db.WriteHeaderRecord(5, 50<<20, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := len(s.Bytes())
+	err = db.WriteHeaderRecord(5, 50<<20, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Bytes()) != size {
+		t.Error("a second header record was appended for the message")
+	}
+	if !db.HaveHeader(5) {
+		t.Error("header record not recorded")
+	}
+
+	// A header record with a valid hash but a payload that doesn't decode
+	hdr, bs := db.encodeRecord(HeaderRecordType, FeatureHashed, []byte("not a header record"))
+	if _, err := appendEncoded(&s, hdr, bs); err != nil {
+		t.Fatal(err)
+	}
+	bad := int64(size)
+
+	// The hash catches a flipped bit in the headers
+	off := offset + int64(binary.Size(Header{})) + 20
+	s.WriteAt([]byte{s.Bytes()[off] ^ 1}, off)
+
+	_, corrupt, err := VerifyStorage(&s, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := make(map[int64]bool)
+	for _, c := range corrupt {
+		found[c.Offset] = true
+	}
+	if !found[offset] {
+		t.Errorf("corrupt header record at %d not reported: %v", offset, corrupt)
+	}
+	if !found[bad] {
+		t.Errorf("undecodable header record at %d not reported: %v", bad, corrupt)
+	}
+}
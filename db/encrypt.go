@@ -0,0 +1,80 @@
+package db
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+)
+
+// keyIterations is the PBKDF2 iteration count used to derive the
+// encryption key from the passphrase.
+const keyIterations = 600000
+
+var (
+	errNoKey   = errors.New("record is encrypted and no key is set")
+	errDecrypt = errors.New("decryption failed")
+)
+
+// newCipher derives the record cipher from the passphrase and the salt in
+// the file header.
+func newCipher(passphrase string, salt uint64) (cipher.AEAD, error) {
+	var saltBytes [8]byte
+	binary.LittleEndian.PutUint64(saltBytes[:], salt)
+	key, err := pbkdf2.Key(sha256.New, passphrase, saltBytes[:], keyIterations, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// newSalt returns a random nonzero salt.
+func newSalt() (uint64, error) {
+	var buf [8]byte
+	for {
+		_, err := rand.Read(buf[:])
+		if err != nil {
+			return 0, err
+		}
+		if salt := binary.LittleEndian.Uint64(buf[:]); salt != 0 {
+			return salt, nil
+		}
+	}
+}
+
+// encrypt seals the record data, prefixed by a random nonce. The record
+// type is authenticated along with it.
+func encrypt(aead cipher.AEAD, rtype uint16, data []byte) []byte {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(data)+aead.Overhead())
+	rand.Read(nonce)
+	return aead.Seal(nonce, nonce, data, recordAD(rtype))
+}
+
+func decrypt(aead cipher.AEAD, rtype uint16, data []byte) ([]byte, error) {
+	if aead == nil {
+		return nil, errNoKey
+	}
+	if len(data) < aead.NonceSize() {
+		return nil, errDecrypt
+	}
+	nonce, data := data[:aead.NonceSize()], data[aead.NonceSize():]
+	plain, err := aead.Open(nil, nonce, data, recordAD(rtype))
+	if err != nil {
+		return nil, errDecrypt
+	}
+	return plain, nil
+}
+
+func recordAD(rtype uint16) []byte {
+	var ad [2]byte
+	binary.LittleEndian.PutUint16(ad[:], rtype)
+	return ad[:]
+}
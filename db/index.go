@@ -0,0 +1,215 @@
+package db
+
+import (
+	"encoding/asn1"
+	"errors"
+)
+
+// IndexRecord describes every message in the vault up to the point where it
+// was written, so that Open doesn't have to read the records before it.
+type IndexRecord []IndexEntry
+
+type IndexEntry struct {
+	MessageID int64
+	// Offset is the offset of the message record, or zero if there is none
+	Offset int64
+	// Header is true if there is a header record for the message
+	Header bool
+	Labels [][]byte
+	Flags  [][]byte `asn1:"optional"`
+	// LabelIDs are used instead of Labels, as in LabelsEntry
+	LabelIDs []int64 `asn1:"optional,tag:0"`
+}
+
+var ErrNoMessage = errors.New("No such message")
+
+// GetMessage returns the message record with the given message ID.
+func (db *DB) GetMessage(msgid int64) (*MessageRecord, error) {
+	defer db.Unlock()
+	db.Lock()
+
+	offset, ok := db.offsets.get(msgid)
+	if !ok {
+		return nil, ErrNoMessage
+	}
+
+	readPtr := db.readPtr
+	db.readPtr = offset
+	rec, err := db.nextRecord(AnyType)
+	db.readPtr = readPtr
+	if err != nil {
+		return nil, err
+	}
+
+	msg, ok := rec.(MessageRecord)
+	if !ok || msg.MessageID != msgid {
+		return nil, &RecordError{offset, errors.New("not the expected message record")}
+	}
+	return &msg, nil
+}
+
+// Unindexed returns the number of message and header records written after
+// the last index record.
+func (db *DB) Unindexed() int {
+	defer db.Unlock()
+	db.Lock()
+	return db.unindexed
+}
+
+// WriteIndex appends an index record describing the current contents of the
+// vault, followed by a checkpoint, and points the file header at it. The
+// index is preceded by a record of all label names, which the header points
+// at, and with a Bloom filter followed by the offsets record. The scan
+// record, which opening from the index would skip, is repeated after it.
+func (db *DB) WriteIndex() error {
+	defer db.Unlock()
+	db.Lock()
+
+	bs, err := asn1.Marshal(db.index(&db.offsets))
+	if err != nil {
+		return err
+	}
+	names := db.names.since(0)
+	nbs, err := asn1.Marshal(names)
+	if err != nil {
+		return err
+	}
+
+	offset, err := db.writeRecord(LabelNamesRecordType, db.compressFeature, nbs)
+	if err != nil {
+		return err
+	}
+	db.names.wrote(names)
+	_, err = db.writeRecord(IndexRecordType, db.compressFeature|db.hashFeature, bs)
+	if err != nil {
+		return err
+	}
+	if db.offsets.bloom != nil {
+		bs, err := asn1.Marshal(db.offsets.record())
+		if err != nil {
+			return err
+		}
+		_, err = db.writeRecord(OffsetsRecordType, db.compressFeature|db.hashFeature, bs)
+		if err != nil {
+			return err
+		}
+	}
+	db.unindexed = 0
+	if len(db.scan.Ranges) > 0 {
+		err = db.writeScan(db.scan)
+		if err != nil {
+			return err
+		}
+	}
+	err = db.writeCheckpoint()
+	if err != nil {
+		return err
+	}
+	db.header.HavePtr = uint64(offset)
+	return db.writeHeader()
+}
+
+// index returns the index record for the current state, with message
+// records at the given offsets.
+func (db *DB) index(offsets *offsetTable) IndexRecord {
+	var idx IndexRecord
+	seen := make(map[int64]bool)
+	add := func(msgid int64) {
+		if seen[msgid] {
+			return
+		}
+		seen[msgid] = true
+		offset, ok := offsets.get(msgid)
+		if !ok && !db.haveHeader[msgid] && len(db.labels[msgid]) == 0 && len(db.flags[msgid]) == 0 {
+			return
+		}
+		idx = append(idx, IndexEntry{
+			MessageID: msgid,
+			Offset:    offset,
+			Header:    db.haveHeader[msgid],
+			LabelIDs:  db.names.idsOf(db.labels[msgid]),
+			Flags:     stringSliceToBytes(db.flags[msgid]),
+		})
+	}
+	offsets.each(func(msgid, _ int64) {
+		add(msgid)
+	})
+	for msgid := range db.haveHeader {
+		add(msgid)
+	}
+	for msgid := range db.labels {
+		add(msgid)
+	}
+	for msgid := range db.flags {
+		add(msgid)
+	}
+	return idx
+}
+
+// readIndex loads the state from the index record at offset, or from the
+// label names record there and the index record following it, leaving the
+// read pointer after the index. With a Bloom filter the offsets are taken
+// from the offsets record after the index if there is one, and otherwise
+// collected into the table from the index entries.
+func (db *DB) readIndex(offset int64) error {
+	db.readPtr = offset
+	rec, err := db.nextRecord(AnyType)
+	if err != nil {
+		return err
+	}
+	if names, ok := rec.(LabelNamesRecord); ok {
+		db.names.add(names)
+		rec, err = db.nextRecord(AnyType)
+		if err != nil {
+			return err
+		}
+	}
+
+	idx, ok := rec.(IndexRecord)
+	if !ok {
+		return errors.New("have pointer does not point at an index record")
+	}
+
+	bloom := db.offsets.bloom != nil
+	haveTable := false
+	if bloom {
+		next := db.readPtr
+		rec, err := db.nextRecord(AnyType)
+		if offs, ok := rec.(OffsetsRecord); ok && err == nil {
+			err = db.offsets.loadRecord(offs)
+			if err != nil {
+				return err
+			}
+			haveTable = true
+		} else {
+			db.readPtr = next
+		}
+	}
+	var table []byte
+	for _, e := range idx {
+		switch {
+		case e.Offset == 0 || haveTable:
+		case bloom:
+			table = appendTableEntry(table, e.MessageID, e.Offset)
+		default:
+			db.offsets.set(e.MessageID, e.Offset)
+		}
+		if e.Header {
+			db.haveHeader[e.MessageID] = true
+		}
+		labels, err := db.names.labels(e.Labels, e.LabelIDs)
+		if err != nil {
+			return err
+		}
+		if len(labels) > 0 {
+			db.labels[e.MessageID] = labels
+		}
+		if len(e.Flags) > 0 {
+			db.flags[e.MessageID] = db.names.internBytes(e.Flags)
+		}
+	}
+	if bloom && !haveTable {
+		db.offsets.loadTable(table)
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package db
+
+import "fmt"
+
+// LabelNamesRecord gives the names of the label IDs First, First+1 and so
+// on. Labels and index entries refer to labels by these IDs, so that each
+// name is stored once instead of with every message.
+type LabelNamesRecord struct {
+	First int64
+	Names [][]byte
+}
+
+// labelNames is the table of label IDs, and the pool of label and flag
+// strings shared by all messages in memory.
+type labelNames struct {
+	names []string
+	ids   map[string]int64
+	// written is the number of IDs whose names are in the vault
+	written int
+	strs    map[string]string
+}
+
+func newLabelNames() labelNames {
+	return labelNames{ids: make(map[string]int64), strs: make(map[string]string)}
+}
+
+// intern returns the pooled copy of s.
+func (n *labelNames) intern(s string) string {
+	if p, ok := n.strs[s]; ok {
+		return p
+	}
+	n.strs[s] = s
+	return s
+}
+
+func (n *labelNames) internStrings(ss []string) []string {
+	var res []string
+	for _, s := range ss {
+		res = append(res, n.intern(s))
+	}
+	return res
+}
+
+func (n *labelNames) internBytes(bs [][]byte) []string {
+	var res []string
+	for _, b := range bs {
+		if p, ok := n.strs[string(b)]; ok {
+			res = append(res, p)
+		} else {
+			res = append(res, n.intern(string(b)))
+		}
+	}
+	return res
+}
+
+// add records the names of a label names record read from the vault.
+func (n *labelNames) add(rec LabelNamesRecord) {
+	for i, b := range rec.Names {
+		id := int(rec.First) + i
+		for len(n.names) <= id {
+			n.names = append(n.names, "")
+		}
+		name := n.intern(string(b))
+		n.names[id] = name
+		n.ids[name] = int64(id)
+	}
+	n.wrote(rec)
+}
+
+// resolve returns the labels with the given IDs.
+func (n *labelNames) resolve(ids []int64) ([]string, error) {
+	var res []string
+	for _, id := range ids {
+		if id < 0 || id >= int64(len(n.names)) {
+			return nil, fmt.Errorf("unknown label ID %d", id)
+		}
+		res = append(res, n.names[id])
+	}
+	return res, nil
+}
+
+// idsOf returns the IDs of labels, assigning new ones as needed.
+func (n *labelNames) idsOf(labels []string) []int64 {
+	var res []int64
+	for _, l := range labels {
+		id, ok := n.ids[l]
+		if !ok {
+			id = int64(len(n.names))
+			l = n.intern(l)
+			n.names = append(n.names, l)
+			n.ids[l] = id
+		}
+		res = append(res, id)
+	}
+	return res
+}
+
+// since returns a record of the names of the IDs from first on.
+func (n *labelNames) since(first int) LabelNamesRecord {
+	rec := LabelNamesRecord{First: int64(first)}
+	for _, name := range n.names[first:] {
+		rec.Names = append(rec.Names, []byte(name))
+	}
+	return rec
+}
+
+// wrote marks the names of rec as being in the vault.
+func (n *labelNames) wrote(rec LabelNamesRecord) {
+	if end := int(rec.First) + len(rec.Names); end > n.written {
+		n.written = end
+	}
+}
+
+// labels returns the labels of an entry, given either by ID or, in entries
+// written before labels were interned, by name.
+func (n *labelNames) labels(names [][]byte, ids []int64) ([]string, error) {
+	if len(ids) > 0 {
+		return n.resolve(ids)
+	}
+	return n.internBytes(names), nil
+}
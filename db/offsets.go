@@ -0,0 +1,318 @@
+package db
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"sort"
+)
+
+// OffsetsRecord follows the index written by a vault opened with a Bloom
+// filter, holding the offsets of the index in the sorted table and filter
+// of offsetTable, so that opening it with a filter again needs neither a
+// map nor sorting or hashing. Others skip it and use the offsets in the
+// index entries.
+type OffsetsRecord struct {
+	// Table holds an entry per message, its message ID and the offset of
+	// its message record, each 8 bytes big-endian, ordered by message ID
+	Table []byte
+	// Bloom holds the bits of the filter, which has Hashes hashes and is
+	// sized for Capacity message IDs
+	Bloom    []byte
+	Hashes   int
+	Capacity int
+}
+
+// offsetTable maps message IDs to the offsets of their message records,
+// doubling as the set of messages in the vault. By default it's a map. With
+// a false positive rate the entries are kept in a table sorted by message
+// ID instead, which takes less than half the memory, behind a Bloom filter
+// that answers most lookups of messages not in the vault without searching
+// it. Lookups are exact either way: a message the filter might have is
+// looked up in the table, so a false positive costs a search but never
+// makes a message seem stored.
+type offsetTable struct {
+	// added holds the entries, or with a filter those added since the
+	// table was built
+	added map[int64]int64
+	// sorted is the table, as in OffsetsRecord, with offset zero for the
+	// entries deleted since it was built; live is the number of others
+	sorted []byte
+	live   int
+	bloom  *bloomFilter
+	fpRate float64
+}
+
+const tableEntryLen = 16
+
+func newOffsetTable(fpRate float64) offsetTable {
+	t := offsetTable{added: make(map[int64]int64), fpRate: fpRate}
+	if fpRate > 0 {
+		t.bloom = newBloomFilter(0, fpRate)
+	}
+	return t
+}
+
+func tableEntry(table []byte, i int) (msgid, offset int64) {
+	e := table[i*tableEntryLen:]
+	return int64(binary.BigEndian.Uint64(e)), int64(binary.BigEndian.Uint64(e[8:]))
+}
+
+func appendTableEntry(table []byte, msgid, offset int64) []byte {
+	var e [tableEntryLen]byte
+	binary.BigEndian.PutUint64(e[:], uint64(msgid))
+	binary.BigEndian.PutUint64(e[8:], uint64(offset))
+	return append(table, e[:]...)
+}
+
+// tableByID sorts the entries of a table by message ID.
+type tableByID []byte
+
+func (t tableByID) Len() int { return len(t) / tableEntryLen }
+
+func (t tableByID) Less(i, j int) bool {
+	a, _ := tableEntry(t, i)
+	b, _ := tableEntry(t, j)
+	return a < b
+}
+
+func (t tableByID) Swap(i, j int) {
+	var tmp [tableEntryLen]byte
+	a := t[i*tableEntryLen : (i+1)*tableEntryLen]
+	b := t[j*tableEntryLen : (j+1)*tableEntryLen]
+	copy(tmp[:], a)
+	copy(a, b)
+	copy(b, tmp[:])
+}
+
+// loadTable takes table, with entries in any order, as the sorted table of
+// a table with a filter that is still empty, such as when loading an index.
+func (t *offsetTable) loadTable(table []byte) {
+	sort.Sort(tableByID(table))
+	t.sorted, t.live = table, len(table)/tableEntryLen
+	t.buildFilter()
+}
+
+// loadRecord is like loadTable for the table and filter of rec.
+func (t *offsetTable) loadRecord(rec OffsetsRecord) error {
+	if len(rec.Table)%tableEntryLen != 0 {
+		return errors.New("offsets table has a partial entry")
+	}
+	if !sort.IsSorted(tableByID(rec.Table)) {
+		return errors.New("offsets table is not sorted")
+	}
+	t.sorted, t.live = rec.Table, len(rec.Table)/tableEntryLen
+	size, hashes := bloomSize(rec.Capacity, t.fpRate)
+	if rec.Capacity < t.live || len(rec.Bloom) != size || rec.Hashes != hashes {
+		// Written with another false positive rate
+		t.buildFilter()
+		return nil
+	}
+	t.bloom = &bloomFilter{bits: rec.Bloom, hashes: rec.Hashes, capacity: rec.Capacity}
+	return nil
+}
+
+// record returns the table and filter as an OffsetsRecord, after merging
+// the entries added into the table.
+func (t *offsetTable) record() OffsetsRecord {
+	t.rebuild()
+	return OffsetsRecord{Table: t.sorted, Bloom: t.bloom.bits, Hashes: t.bloom.hashes, Capacity: t.bloom.capacity}
+}
+
+// rebuild merges the entries added into the table, dropping the deleted
+// ones, and builds the filter again.
+func (t *offsetTable) rebuild() {
+	added := make([]int64, 0, len(t.added))
+	for msgid := range t.added {
+		added = append(added, msgid)
+	}
+	sort.Slice(added, func(i, j int) bool { return added[i] < added[j] })
+
+	sorted := make([]byte, 0, t.len()*tableEntryLen)
+	n := len(t.sorted) / tableEntryLen
+	for i, j := 0, 0; i < n || j < len(added); {
+		if i < n {
+			msgid, offset := tableEntry(t.sorted, i)
+			if offset == 0 {
+				i++
+				continue
+			}
+			if j == len(added) || msgid < added[j] {
+				sorted = appendTableEntry(sorted, msgid, offset)
+				i++
+				continue
+			}
+		}
+		sorted = appendTableEntry(sorted, added[j], t.added[added[j]])
+		j++
+	}
+	t.sorted, t.live = sorted, len(sorted)/tableEntryLen
+	t.added = make(map[int64]int64)
+	t.buildFilter()
+}
+
+// buildFilter builds the filter from the table, with room for a quarter as
+// many more entries.
+func (t *offsetTable) buildFilter() {
+	n := t.live + len(t.added)
+	t.bloom = newBloomFilter(n+n/4, t.fpRate)
+	t.each(func(msgid, _ int64) {
+		t.bloom.add(msgid)
+	})
+}
+
+// search returns the index of msgid in the table, or -1.
+func (t *offsetTable) search(msgid int64) int {
+	n := len(t.sorted) / tableEntryLen
+	i := sort.Search(n, func(i int) bool {
+		id, _ := tableEntry(t.sorted, i)
+		return id >= msgid
+	})
+	if i < n {
+		if id, _ := tableEntry(t.sorted, i); id == msgid {
+			return i
+		}
+	}
+	return -1
+}
+
+func (t *offsetTable) get(msgid int64) (int64, bool) {
+	if offset, ok := t.added[msgid]; ok {
+		return offset, true
+	}
+	if t.bloom == nil || !t.bloom.has(msgid) {
+		return 0, false
+	}
+	if i := t.search(msgid); i >= 0 {
+		if _, offset := tableEntry(t.sorted, i); offset != 0 {
+			return offset, true
+		}
+	}
+	return 0, false
+}
+
+// setTableOffset sets the offset of entry i of the table.
+func (t *offsetTable) setTableOffset(i int, offset int64) {
+	e := t.sorted[i*tableEntryLen:]
+	if binary.BigEndian.Uint64(e[8:]) == 0 {
+		t.live++
+	}
+	if offset == 0 {
+		t.live--
+	}
+	binary.BigEndian.PutUint64(e[8:], uint64(offset))
+}
+
+func (t *offsetTable) set(msgid, offset int64) {
+	if t.bloom == nil {
+		t.added[msgid] = offset
+		return
+	}
+	if i := t.search(msgid); i >= 0 {
+		t.setTableOffset(i, offset)
+		return
+	}
+	t.added[msgid] = offset
+	t.bloom.add(msgid)
+	if t.len() > t.bloom.capacity {
+		t.rebuild()
+	}
+}
+
+func (t *offsetTable) delete(msgid int64) {
+	delete(t.added, msgid)
+	if t.bloom == nil {
+		return
+	}
+	if i := t.search(msgid); i >= 0 {
+		if _, offset := tableEntry(t.sorted, i); offset != 0 {
+			t.setTableOffset(i, 0)
+		}
+	}
+}
+
+func (t *offsetTable) len() int {
+	return t.live + len(t.added)
+}
+
+// each calls fn for every entry, in no particular order.
+func (t *offsetTable) each(fn func(msgid, offset int64)) {
+	for i := 0; i < len(t.sorted)/tableEntryLen; i++ {
+		if msgid, offset := tableEntry(t.sorted, i); offset != 0 {
+			fn(msgid, offset)
+		}
+	}
+	for msgid, offset := range t.added {
+		fn(msgid, offset)
+	}
+}
+
+// bloomFilter is a Bloom filter of message IDs, sized for capacity IDs at
+// its false positive rate.
+type bloomFilter struct {
+	bits     []byte
+	hashes   int
+	capacity int
+}
+
+// newBloomFilter returns a filter for n IDs, and at least a thousand, with
+// the false positive rate fpRate.
+func newBloomFilter(n int, fpRate float64) *bloomFilter {
+	if n < 1024 {
+		n = 1024
+	}
+	size, hashes := bloomSize(n, fpRate)
+	return &bloomFilter{bits: make([]byte, size), hashes: hashes, capacity: n}
+}
+
+// bloomSize returns the size in bytes and number of hashes of a filter for
+// n IDs with the false positive rate fpRate, which takes -ln(fpRate)/ln(2)²
+// bits per ID: 4.8 bits at 10%, 9.6 at 1% and 14.4 at 0.1%.
+func bloomSize(n int, fpRate float64) (int, int) {
+	nbits := math.Ceil(-float64(n) * math.Log(fpRate) / (math.Ln2 * math.Ln2))
+	hashes := int(math.Round(nbits / float64(n) * math.Ln2))
+	if hashes < 1 {
+		hashes = 1
+	}
+	return int(nbits)/8 + 1, hashes
+}
+
+// positions calls fn with the bit positions of msgid, derived from two
+// hashes of it as in Kirsch and Mitzenmacher's double hashing.
+func (f *bloomFilter) positions(msgid int64, fn func(pos uint64)) {
+	nbits := uint64(len(f.bits)) * 8
+	h1 := mix64(uint64(msgid))
+	h2 := mix64(h1) | 1
+	for i := 0; i < f.hashes; i++ {
+		fn((h1 + uint64(i)*h2) % nbits)
+	}
+}
+
+func (f *bloomFilter) add(msgid int64) {
+	f.positions(msgid, func(pos uint64) {
+		f.bits[pos/8] |= 1 << (pos % 8)
+	})
+}
+
+// has returns false if msgid was never added, and true if it was or for a
+// fraction of the others given by the false positive rate.
+func (f *bloomFilter) has(msgid int64) bool {
+	res := true
+	f.positions(msgid, func(pos uint64) {
+		if f.bits[pos/8]&(1<<(pos%8)) == 0 {
+			res = false
+		}
+	})
+	return res
+}
+
+// mix64 is the finalizer of SplitMix64, which spreads message IDs that are
+// close together over the whole range.
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
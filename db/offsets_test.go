@@ -0,0 +1,175 @@
+package db
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestBloomFilter(t *testing.T) {
+	const n = 100000
+	for _, rate := range []float64{0.1, 0.01, 0.001} {
+		f := newBloomFilter(n, rate)
+		for i := int64(0); i < n; i++ {
+			f.add(1500000000000000000 + i*7919)
+		}
+		for i := int64(0); i < n; i++ {
+			if !f.has(1500000000000000000 + i*7919) {
+				t.Fatalf("rate %v: message %d added but not in the filter", rate, i)
+			}
+		}
+		fps := 0
+		for i := int64(1); i <= n; i++ {
+			if f.has(-i) {
+				fps++
+			}
+		}
+		if got := float64(fps) / n; got > 1.5*rate {
+			t.Errorf("rate %v: %.4f false positives", rate, got)
+		}
+	}
+}
+
+// TestOffsetTable checks the table against a map through random changes,
+// with and without a filter, across rebuilds as entries are added and after
+// loading it from its record.
+func TestOffsetTable(t *testing.T) {
+	for _, rate := range []float64{0, 0.5, 0.01} {
+		rnd := rand.New(rand.NewSource(1))
+		tbl := newOffsetTable(rate)
+		want := make(map[int64]int64)
+		for i := 0; i < 20000; i++ {
+			msgid := rnd.Int63n(5000) + 1
+			switch op := rnd.Intn(10); {
+			case op < 6:
+				offset := rnd.Int63n(1<<40) + 1
+				tbl.set(msgid, offset)
+				want[msgid] = offset
+			case op < 8:
+				tbl.delete(msgid)
+				delete(want, msgid)
+			default:
+				offset, ok := tbl.get(msgid)
+				if woffset, wok := want[msgid]; offset != woffset || ok != wok {
+					t.Fatalf("rate %v: got %d, %v for message %d, not %d, %v", rate, offset, ok, msgid, woffset, wok)
+				}
+			}
+			if i == 10000 && rate > 0 {
+				rec := tbl.record()
+				tbl = newOffsetTable(rate)
+				if err := tbl.loadRecord(rec); err != nil {
+					t.Fatalf("rate %v: %v", rate, err)
+				}
+			}
+		}
+
+		if tbl.len() != len(want) {
+			t.Errorf("rate %v: %d entries, not %d", rate, tbl.len(), len(want))
+		}
+		got := make(map[int64]int64)
+		tbl.each(func(msgid, offset int64) {
+			if _, ok := got[msgid]; ok {
+				t.Errorf("rate %v: message %d listed twice", rate, msgid)
+			}
+			got[msgid] = offset
+		})
+		for msgid, offset := range want {
+			if got[msgid] != offset {
+				t.Errorf("rate %v: listed offset %d for message %d, not %d", rate, got[msgid], msgid, offset)
+			}
+		}
+		for msgid := int64(1); msgid <= 5000; msgid++ {
+			offset, ok := tbl.get(msgid)
+			if woffset, wok := want[msgid]; offset != woffset || ok != wok {
+				t.Errorf("rate %v: got %d, %v for message %d, not %d, %v", rate, offset, ok, msgid, woffset, wok)
+			}
+		}
+	}
+}
+
+func TestBloomFPRate(t *testing.T) {
+	s := testVault(t, "one", "two", "three")
+	for _, rate := range []float64{1, -0.1} {
+		if _, err := OpenStorageWithOptions(s, Options{BloomFPRate: rate}); err == nil {
+			t.Errorf("false positive rate %v accepted", rate)
+		}
+	}
+	opts := Options{BloomFPRate: 0.01}
+	db, err := OpenStorageWithOptions(s, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.offsets.bloom == nil {
+		t.Error("opened without a filter")
+	}
+
+	err = db.WriteMessage(4, []byte("four"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.WriteDelete([]int64{2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := func(db *DB, when string) {
+		t.Helper()
+		for msgid, want := range map[int64]bool{1: true, 2: false, 3: true, 4: true, 5: false} {
+			if db.HaveUID(msgid) != want {
+				t.Errorf("%s: HaveUID(%d) is %v", when, msgid, !want)
+			}
+		}
+		if n := db.Size(); n != 3 {
+			t.Errorf("%s: size %d, not 3", when, n)
+		}
+		msg, err := db.GetMessage(4)
+		if err != nil || string(msg.Data) != "four" {
+			t.Errorf("%s: message 4 is %v, %v", when, msg, err)
+		}
+	}
+	check(db, "after writing")
+
+	_, err = db.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.offsets.bloom == nil {
+		t.Error("compaction dropped the filter")
+	}
+	check(db, "after compaction")
+	err = db.WriteIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = OpenStorageWithOptions(s, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(db.offsets.added) != 0 {
+		t.Errorf("index loaded with %d entries in the map", len(db.offsets.added))
+	}
+	check(db, "after loading the index")
+	db.Close()
+
+	// The offsets record is skipped without a filter
+	db, err = OpenStorageWithOptions(s, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.offsets.bloom != nil {
+		t.Error("opened with a filter")
+	}
+	check(db, "without a filter")
+	db.Close()
+
+	// A filter of another rate is built again
+	db, err = OpenStorageWithOptions(s, Options{BloomFPRate: 0.2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(db, "at another rate")
+	db.Close()
+}
@@ -0,0 +1,227 @@
+package db
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// MessageReader returns a reader for the data of the message with the given
+// message ID, decompressed as it is read, so that a large message is never
+// held in memory as a whole. Encrypted records are decrypted in memory
+// first, as the cipher authenticates the record as a whole. The hash of the
+// record is checked when the end of the data is reached, and a mismatch is
+// returned instead of io.EOF. The reader must be closed, and must not be
+// used across Compact or Dedupe.
+func (db *DB) MessageReader(msgid int64) (io.ReadCloser, error) {
+	db.Lock()
+	offset, ok := db.offsets.get(msgid)
+	fd, aead := db.fd, db.aead
+	db.Unlock()
+	if !ok {
+		return nil, ErrNoMessage
+	}
+
+	var hdr Header
+	err := binary.Read(io.NewSectionReader(fd, offset, int64(binary.Size(hdr))), binary.LittleEndian, &hdr)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, &truncatedError{offset}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if hdr.Type != MessageRecordType {
+		return nil, &RecordError{offset, errors.New("not the expected message record")}
+	}
+
+	var r io.Reader = io.NewSectionReader(fd, offset+int64(binary.Size(hdr)), int64(hdr.Length))
+	if hdr.FeatureBits&FeatureEncrypted != 0 {
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		data, err = decrypt(aead, hdr.Type, data)
+		if err != nil {
+			return nil, &RecordError{offset, err}
+		}
+		r = bytes.NewReader(data)
+	}
+
+	mr := &messageReader{offset: offset}
+	if n := hashLen(hdr.FeatureBits); n > 0 {
+		mr.want = make([]byte, n)
+		_, err := io.ReadFull(r, mr.want)
+		if err != nil {
+			return nil, &RecordError{offset, errors.New("record too short for hash")}
+		}
+		mr.hash = sha1.New()
+		if hdr.FeatureBits&FeatureHashed256 != 0 {
+			mr.hash = sha256.New()
+		}
+	}
+
+	switch {
+	case hdr.FeatureBits&FeatureZstd != 0:
+		dec, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		mr.closer = dec.IOReadCloser()
+		r = mr.closer
+	case hdr.FeatureBits&FeatureCompressed != 0:
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, &RecordError{offset, err}
+		}
+		mr.closer = gz
+		r = gz
+	}
+	if mr.hash != nil {
+		r = io.TeeReader(r, mr.hash)
+	}
+	mr.payload = r
+
+	// The payload is the DER encoding of the MessageRecord, a sequence of
+	// the message ID, the data as an octet string and the optional thread
+	// ID. Only the data is passed on to the caller.
+	err = mr.expect(0x30)
+	if err == nil {
+		err = mr.expect(0x02)
+	}
+	var id int64
+	if err == nil {
+		id, err = mr.readInt()
+	}
+	if err == nil && id != msgid {
+		err = errors.New("not the expected message record")
+	}
+	if err == nil {
+		err = mr.expect(0x04)
+	}
+	if err != nil {
+		mr.Close()
+		return nil, &RecordError{offset, err}
+	}
+	return mr, nil
+}
+
+// digest is the part of hash.Hash used to check a record hash.
+type digest interface {
+	io.Writer
+	Sum(b []byte) []byte
+}
+
+type messageReader struct {
+	offset  int64
+	payload io.Reader
+	closer  io.ReadCloser
+	hash    digest
+	want    []byte
+	// left is the length of the DER element being read
+	left int64
+	done bool
+}
+
+// expect reads the tag and length of the next DER element, which must have
+// the given tag, leaving the length in left.
+func (mr *messageReader) expect(tag byte) error {
+	var buf [1]byte
+	_, err := io.ReadFull(mr.payload, buf[:])
+	if err != nil {
+		return err
+	}
+	if buf[0] != tag {
+		return errors.New("unexpected ASN.1 tag")
+	}
+	_, err = io.ReadFull(mr.payload, buf[:])
+	if err != nil {
+		return err
+	}
+	if buf[0] < 0x80 {
+		mr.left = int64(buf[0])
+		return nil
+	}
+	n := int(buf[0] & 0x7f)
+	if n == 0 || n > 8 {
+		return errors.New("unsupported ASN.1 length")
+	}
+	mr.left = 0
+	for i := 0; i < n; i++ {
+		_, err = io.ReadFull(mr.payload, buf[:])
+		if err != nil {
+			return err
+		}
+		mr.left = mr.left<<8 | int64(buf[0])
+	}
+	return nil
+}
+
+// readInt reads the contents of a DER integer of length left.
+func (mr *messageReader) readInt() (int64, error) {
+	if mr.left == 0 || mr.left > 8 {
+		return 0, errors.New("unsupported ASN.1 integer")
+	}
+	buf := make([]byte, mr.left)
+	_, err := io.ReadFull(mr.payload, buf)
+	if err != nil {
+		return 0, err
+	}
+	// Sign extend from the first byte
+	v := int64(int8(buf[0]))
+	for _, b := range buf[1:] {
+		v = v<<8 | int64(b)
+	}
+	return v, nil
+}
+
+func (mr *messageReader) Read(p []byte) (int, error) {
+	if mr.done {
+		return 0, io.EOF
+	}
+	if mr.left == 0 {
+		return 0, mr.finish()
+	}
+	if int64(len(p)) > mr.left {
+		p = p[:mr.left]
+	}
+	n, err := mr.payload.Read(p)
+	mr.left -= int64(n)
+	if err == io.EOF {
+		if mr.left > 0 {
+			return n, &RecordError{mr.offset, io.ErrUnexpectedEOF}
+		}
+		err = nil
+	}
+	if err != nil {
+		return n, &RecordError{mr.offset, err}
+	}
+	return n, nil
+}
+
+// finish reads what follows the data, so that the hash covers the whole
+// payload, and checks the hash.
+func (mr *messageReader) finish() error {
+	mr.done = true
+	_, err := io.Copy(ioutil.Discard, mr.payload)
+	if err != nil {
+		return &RecordError{mr.offset, err}
+	}
+	if mr.hash != nil && !bytes.Equal(mr.hash.Sum(nil), mr.want) {
+		return &RecordError{mr.offset, errHashMismatch}
+	}
+	return io.EOF
+}
+
+func (mr *messageReader) Close() error {
+	if mr.closer != nil {
+		return mr.closer.Close()
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package db
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+func TestMessageReader(t *testing.T) {
+	data := bytes.Repeat([]byte("Subject: large\r\n\r\nline of text\r\n"), 10000)
+	for _, algo := range []string{"gzip", "zstd", "none"} {
+		t.Run(algo, func(t *testing.T) {
+			db, err := OpenStorage(&MemoryStorage{}, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = db.SetCompression(algo)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = db.WriteMessage(1, data)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rd, err := db.MessageReader(1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := ioutil.ReadAll(rd)
+			rd.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("read %d bytes, not the %d written", len(got), len(data))
+			}
+		})
+	}
+
+	db, err := OpenStorage(&MemoryStorage{}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.MessageReader(1); err != ErrNoMessage {
+		t.Errorf("MessageReader of a missing message returned %v, not ErrNoMessage", err)
+	}
+}
+
+func TestMessageReaderCorrupt(t *testing.T) {
+	var s MemoryStorage
+	db, err := OpenStorage(&s, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.SetCompression("none")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("Subject: corrupt\r\n\r\nbody\r\n")
+	err = db.WriteMessage(1, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Flip a bit in the middle of the message data
+	off := int64(len(s.Bytes()) - len(data)/2)
+	s.WriteAt([]byte{s.Bytes()[off] ^ 1}, off)
+
+	rd, err := db.MessageReader(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rd.Close()
+	got, err := ioutil.ReadAll(rd)
+	if rerr, ok := err.(*RecordError); !ok || rerr.Err != errHashMismatch {
+		t.Fatalf("reading a corrupt message returned %v, not a hash mismatch", err)
+	}
+	if len(got) != len(data) {
+		t.Errorf("read %d bytes before the mismatch, not %d", len(got), len(data))
+	}
+}
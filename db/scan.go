@@ -0,0 +1,68 @@
+package db
+
+import (
+	"encoding/asn1"
+)
+
+// ScanRecord lists the UID ranges of the mailbox whose messages have all
+// been stored, so that an interrupted sync can resume without scanning them
+// again. A later ScanRecord supersedes earlier ones.
+type ScanRecord struct {
+	UIDValidity int64
+	Ranges      []ScanRange
+}
+
+// ScanRange is an inclusive range of UIDs.
+type ScanRange struct {
+	First int64
+	Last  int64
+}
+
+// Scanned returns the UID ranges last recorded by SetScanned and the
+// UIDVALIDITY they refer to.
+func (db *DB) Scanned() (validity uint32, ranges []ScanRange) {
+	defer db.Unlock()
+	db.Lock()
+	return uint32(db.scan.UIDValidity), append([]ScanRange(nil), db.scan.Ranges...)
+}
+
+// SetScanned records the UID ranges that have been completely synced,
+// appending a scan record unless they are the ones already recorded.
+func (db *DB) SetScanned(validity uint32, ranges []ScanRange) error {
+	rec := ScanRecord{UIDValidity: int64(validity), Ranges: ranges}
+	if len(ranges) == 0 {
+		rec = ScanRecord{}
+	}
+
+	defer db.Unlock()
+	db.Lock()
+	if scanEquals(rec, db.scan) {
+		return nil
+	}
+	err := db.writeScan(rec)
+	if err == nil {
+		db.scan = rec
+	}
+	return err
+}
+
+func (db *DB) writeScan(rec ScanRecord) error {
+	bs, err := asn1.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	_, err = db.writeRecord(ScanRecordType, db.compressFeature, bs)
+	return err
+}
+
+func scanEquals(a, b ScanRecord) bool {
+	if a.UIDValidity != b.UIDValidity || len(a.Ranges) != len(b.Ranges) {
+		return false
+	}
+	for i := range a.Ranges {
+		if a.Ranges[i] != b.Ranges[i] {
+			return false
+		}
+	}
+	return true
+}
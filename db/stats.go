@@ -0,0 +1,122 @@
+package db
+
+import (
+	"encoding/binary"
+	"io"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+type Stats struct {
+	Messages int
+	// Labels maps each label to the number of messages carrying it
+	Labels   map[string]int
+	FileSize int64
+	// StoredBytes is the size of all message records in the file, and
+	// RawBytes an estimate of their size uncompressed.
+	StoredBytes int64
+	RawBytes    int64
+	Created     time.Time
+	Updated     time.Time
+	UIDValidity uint32
+	LastUID     uint32
+}
+
+func (db *DB) Stats() (Stats, error) {
+	defer db.Unlock()
+	db.Lock()
+
+	st := Stats{
+		Messages:    db.offsets.len(),
+		Labels:      make(map[string]int),
+		Created:     time.Unix(int64(db.header.CreateTime), 0),
+		UIDValidity: db.header.UIDValidity,
+		LastUID:     db.header.LastUID,
+	}
+	if db.header.UpdateTime != 0 {
+		st.Updated = time.Unix(int64(db.header.UpdateTime), 0)
+	}
+
+	db.offsets.each(func(msgid, _ int64) {
+		for _, label := range db.labels[msgid] {
+			st.Labels[label]++
+		}
+	})
+
+	hdrLen := int64(binary.Size(Header{}))
+	offset := int64(fileHeaderLength)
+	buf := make([]byte, hdrLen)
+	for {
+		_, err := db.fd.ReadAt(buf, offset)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return st, err
+		}
+
+		hdr := Header{
+			Type:        binary.LittleEndian.Uint16(buf[0:]),
+			FeatureBits: binary.LittleEndian.Uint16(buf[2:]),
+			Length:      binary.LittleEndian.Uint32(buf[4:]),
+		}
+		if hdr.Type == MessageRecordType {
+			st.StoredBytes += int64(hdr.Length)
+			raw, err := db.rawSize(hdr, offset+hdrLen)
+			if err != nil {
+				return st, err
+			}
+			st.RawBytes += raw
+		}
+
+		offset += hdrLen + int64(hdr.Length)
+	}
+	st.FileSize = offset
+
+	return st, nil
+}
+
+// rawSize returns the uncompressed size of the record data at offset. For
+// gzip compressed records this is read from the gzip trailer, which is
+// exact for records smaller than 4 GiB, and for zstd from the frame header.
+// Encrypted records are counted at their stored size.
+func (db *DB) rawSize(hdr Header, offset int64) (int64, error) {
+	if hdr.FeatureBits&FeatureEncrypted != 0 {
+		// Unknown without decrypting the record
+		return int64(hdr.Length), nil
+	}
+	hlen := int64(hashLen(hdr.FeatureBits))
+	length := int64(hdr.Length) - hlen
+	if hdr.FeatureBits&FeatureZstd != 0 {
+		return db.zstdSize(offset+hlen, length)
+	}
+	if hdr.FeatureBits&FeatureCompressed == 0 || length < 4 {
+		return length, nil
+	}
+
+	var isize [4]byte
+	_, err := db.fd.ReadAt(isize[:], offset+int64(hdr.Length)-4)
+	if err != nil {
+		return 0, err
+	}
+	return int64(binary.LittleEndian.Uint32(isize[:])), nil
+}
+
+func (db *DB) zstdSize(offset, length int64) (int64, error) {
+	buf := make([]byte, zstd.HeaderMaxSize)
+	if length < int64(len(buf)) {
+		buf = buf[:length]
+	}
+	_, err := db.fd.ReadAt(buf, offset)
+	if err != nil {
+		return 0, err
+	}
+
+	var zh zstd.Header
+	if zh.Decode(buf) != nil || !zh.HasFCS {
+		// Unknown; count it as stored
+		return length, nil
+	}
+	return int64(zh.FrameContentSize), nil
+}
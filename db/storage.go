@@ -0,0 +1,160 @@
+package db
+
+import (
+	"io"
+	"os"
+	"sync"
+)
+
+// Storage holds the bytes of a vault. Records are appended by writing at the
+// end and read at their offsets, and the file header is rewritten in place.
+type Storage interface {
+	io.ReaderAt
+	io.WriterAt
+	// Size returns the current length in bytes
+	Size() (int64, error)
+	// Truncate drops everything after size bytes
+	Truncate(size int64) error
+	// Sync makes the writes so far durable
+	Sync() error
+	Close() error
+	// Rewrite calls write with new, empty storage and, if it returns nil,
+	// replaces the contents with what was written to it
+	Rewrite(write func(Storage) error) error
+}
+
+// fileStorage is the default Storage, a file on disk.
+type fileStorage struct {
+	*os.File
+	name string
+}
+
+// OpenFile opens or creates the file name as vault storage.
+func OpenFile(name string) (Storage, error) {
+	fd, err := os.OpenFile(name, os.O_CREATE|os.O_RDWR, 0666)
+	if err != nil {
+		return nil, err
+	}
+	return &fileStorage{fd, name}, nil
+}
+
+// OpenFileReadOnly opens the existing file name as vault storage that is
+// only read.
+func OpenFileReadOnly(name string) (Storage, error) {
+	fd, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &fileStorage{fd, name}, nil
+}
+
+func (s *fileStorage) Size() (int64, error) {
+	fi, err := s.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+// Rewrite writes to a temporary file next to the vault, which is renamed
+// over it once it has been completely written.
+func (s *fileStorage) Rewrite(write func(Storage) error) error {
+	tmpName := s.name + ".compact"
+	fd, err := os.OpenFile(tmpName, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0666)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpName)
+
+	err = write(&fileStorage{fd, tmpName})
+	if err != nil {
+		fd.Close()
+		return err
+	}
+	err = fd.Close()
+	if err != nil {
+		return err
+	}
+
+	s.File.Close()
+	err = os.Rename(tmpName, s.name)
+	if err != nil {
+		return err
+	}
+	s.File, err = os.OpenFile(s.name, os.O_RDWR, 0666)
+	return err
+}
+
+// MemoryStorage is Storage held in memory, for tests and for vaults that
+// don't need to outlive the process. The zero value is empty storage ready
+// to use.
+type MemoryStorage struct {
+	mut sync.Mutex
+	buf []byte
+}
+
+// Bytes returns a copy of the contents.
+func (s *MemoryStorage) Bytes() []byte {
+	defer s.mut.Unlock()
+	s.mut.Lock()
+	return append([]byte(nil), s.buf...)
+}
+
+func (s *MemoryStorage) ReadAt(p []byte, off int64) (int, error) {
+	defer s.mut.Unlock()
+	s.mut.Lock()
+	if off >= int64(len(s.buf)) {
+		return 0, io.EOF
+	}
+	n := copy(p, s.buf[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (s *MemoryStorage) WriteAt(p []byte, off int64) (int, error) {
+	defer s.mut.Unlock()
+	s.mut.Lock()
+	if end := off + int64(len(p)); end > int64(len(s.buf)) {
+		s.buf = append(s.buf, make([]byte, end-int64(len(s.buf)))...)
+	}
+	return copy(s.buf[off:], p), nil
+}
+
+func (s *MemoryStorage) Size() (int64, error) {
+	defer s.mut.Unlock()
+	s.mut.Lock()
+	return int64(len(s.buf)), nil
+}
+
+func (s *MemoryStorage) Truncate(size int64) error {
+	defer s.mut.Unlock()
+	s.mut.Lock()
+	if size < int64(len(s.buf)) {
+		s.buf = s.buf[:size]
+	}
+	return nil
+}
+
+func (s *MemoryStorage) Sync() error {
+	return nil
+}
+
+// Close leaves the contents in place, so that the storage can be opened
+// again.
+func (s *MemoryStorage) Close() error {
+	return nil
+}
+
+func (s *MemoryStorage) Rewrite(write func(Storage) error) error {
+	var tmp MemoryStorage
+	err := write(&tmp)
+	if err != nil {
+		return err
+	}
+	defer s.mut.Unlock()
+	s.mut.Lock()
+	s.buf = tmp.buf
+	return nil
+}
@@ -0,0 +1,144 @@
+package db
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"path/filepath"
+	"testing"
+)
+
+// storages returns the Storage implementations, empty, by name.
+func storages(t *testing.T) map[string]Storage {
+	fs, err := OpenFile(filepath.Join(t.TempDir(), "test.vault"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { fs.Close() })
+	return map[string]Storage{"file": fs, "memory": &MemoryStorage{}}
+}
+
+// contents returns all of s.
+func contents(t *testing.T, s Storage) []byte {
+	t.Helper()
+	size, err := s.Size()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, size)
+	_, err = s.ReadAt(buf, 0)
+	if err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+func TestStorage(t *testing.T) {
+	for name, s := range storages(t) {
+		t.Run(name, func(t *testing.T) {
+			s.WriteAt([]byte("hello world"), 0)
+			s.WriteAt([]byte("there"), 6)
+			if got := string(contents(t, s)); got != "hello there" {
+				t.Errorf("contents %q, not %q", got, "hello there")
+			}
+
+			// Reading past the end returns what there is and io.EOF
+			buf := make([]byte, 10)
+			n, err := s.ReadAt(buf, 6)
+			if n != 5 || err != io.EOF {
+				t.Errorf("read at the end returned %d, %v; want 5, io.EOF", n, err)
+			}
+
+			err = s.Truncate(5)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := string(contents(t, s)); got != "hello" {
+				t.Errorf("contents %q after truncation, not %q", got, "hello")
+			}
+
+			// A failed rewrite leaves the contents as they were
+			err = s.Rewrite(func(out Storage) error {
+				out.WriteAt([]byte("partial"), 0)
+				return errors.New("failed")
+			})
+			if err == nil {
+				t.Error("failed rewrite returned no error")
+			}
+			if got := string(contents(t, s)); got != "hello" {
+				t.Errorf("contents %q after failed rewrite, not %q", got, "hello")
+			}
+			err = s.Rewrite(func(out Storage) error {
+				_, err := out.WriteAt([]byte("rewritten"), 0)
+				return err
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := string(contents(t, s)); got != "rewritten" {
+				t.Errorf("contents %q after rewrite, not %q", got, "rewritten")
+			}
+		})
+	}
+}
+
+// TestStorageVault checks that a vault reads the same from every storage,
+// across a compaction and reopening.
+func TestStorageVault(t *testing.T) {
+	var want []byte
+	for name, s := range storages(t) {
+		t.Run(name, func(t *testing.T) {
+			db, err := OpenStorage(s, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := int64(1); i <= 3; i++ {
+				err = db.WriteMessage(i, bytes.Repeat([]byte("message "), int(i)))
+				if err != nil {
+					t.Fatal(err)
+				}
+				db.SetLabels(i, []string{"Inbox"})
+			}
+			err = db.WriteLabels()
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = db.WriteDelete([]int64{2})
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = db.Compact()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// A MemoryStorage is opened again as it is, while the
+			// file is closed and reopened
+			if fs, ok := s.(*fileStorage); ok {
+				db.Close()
+				s, err = OpenFile(fs.name)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer s.Close()
+			}
+			db, err = OpenStorage(s, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := readAll(t, db)
+			if len(got) != 2 || got[1] != "message " || got[3] != "message message message " {
+				t.Errorf("messages after compaction are %v", got)
+			}
+			if labels := db.Labels(3); len(labels) != 1 || labels[0] != "Inbox" {
+				t.Errorf("labels after compaction are %v", labels)
+			}
+			if want == nil {
+				want = contents(t, s)
+			}
+			if n := len(contents(t, s)); n != len(want) {
+				t.Errorf("vault is %d bytes, not %d as in the other storage", n, len(want))
+			}
+		})
+	}
+}
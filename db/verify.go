@@ -0,0 +1,163 @@
+package db
+
+import (
+	"crypto/cipher"
+	"encoding/asn1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Corruption describes a record that failed verification.
+type Corruption struct {
+	Offset int64
+	// MessageID is zero unless the record is a message or header record
+	// that could at least be decoded.
+	MessageID int64
+	Err       error
+}
+
+// Verify reads every record in the named vault, checking the hash of
+// hashed records and the integrity of compressed ones, and that each
+// checkpoint matches the records before it. A vault with checkpoints that
+// doesn't end with one is reported as truncated. It returns the number of
+// records read and the ones found to be corrupt. A non-nil error
+// means the vault could not be read to the end. Unlike Open, Verify does
+// not stop at the first corrupt record.
+func Verify(name string) (int, []Corruption, error) {
+	return VerifyKey(name, "")
+}
+
+// VerifyKey is like Verify, but also decrypts and verifies encrypted records
+// using a key derived from passphrase.
+func VerifyKey(name string, passphrase string) (int, []Corruption, error) {
+	fd, err := os.Open(name)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer fd.Close()
+	return verify(fd, passphrase)
+}
+
+// VerifyStorage is like VerifyKey for a vault kept in s.
+func VerifyStorage(s Storage, passphrase string) (int, []Corruption, error) {
+	return verify(s, passphrase)
+}
+
+func verify(rd io.ReaderAt, passphrase string) (int, []Corruption, error) {
+	r := io.NewSectionReader(rd, 0, 1<<62)
+	var fhdr FileHeader
+	err := binary.Read(r, binary.LittleEndian, &fhdr)
+	if err != nil {
+		return 0, nil, err
+	}
+	if fhdr.Magic != fileMagic {
+		return 0, nil, errors.New("Incorrect file format")
+	}
+	if fhdr.Version > FileVersion {
+		return 0, nil, fmt.Errorf("Vault is version %d, newer than the supported version %d", fhdr.Version, FileVersion)
+	}
+
+	var aead cipher.AEAD
+	if passphrase != "" && fhdr.KeySalt != 0 {
+		aead, err = newCipher(passphrase, fhdr.KeySalt)
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+
+	var nrecords int
+	var corrupt []Corruption
+	ck := newCheckpointer(true)
+	for {
+		offset, _ := r.Seek(0, io.SeekCurrent)
+
+		var hdr Header
+		err := binary.Read(r, binary.LittleEndian, &hdr)
+		if err == io.EOF {
+			if ck.seen && ck.since > 0 {
+				err := fmt.Errorf("no checkpoint after the last %d records; the vault is truncated or was not closed cleanly", ck.since)
+				corrupt = append(corrupt, Corruption{Offset: offset, Err: err})
+			}
+			return nrecords, corrupt, nil
+		}
+		if err != nil {
+			corrupt = append(corrupt, Corruption{Offset: offset, Err: errors.New("truncated record header")})
+			return nrecords, corrupt, nil
+		}
+
+		data := make([]byte, hdr.Length)
+		_, err = io.ReadFull(r, data)
+		if err != nil {
+			corrupt = append(corrupt, Corruption{Offset: offset, Err: errors.New("truncated record")})
+			return nrecords, corrupt, nil
+		}
+		nrecords++
+		ck.add(hdr, data)
+
+		msgid, err := verifyRecord(aead, hdr, data)
+		if err != nil {
+			corrupt = append(corrupt, Corruption{Offset: offset, MessageID: msgid, Err: err})
+		}
+
+		if hdr.Type == CheckpointRecordType {
+			var cp CheckpointRecord
+			if plain, err := decodePayload(aead, hdr, data); err != nil {
+				// Already reported; check the next checkpoint from this one
+				ck.valid = false
+			} else if _, err := asn1.Unmarshal(plain, &cp); err != nil {
+				ck.valid = false
+			} else if !ck.check(cp) {
+				err := fmt.Errorf("checkpoint does not match the %d records before it", nrecords-1)
+				corrupt = append(corrupt, Corruption{Offset: offset, Err: err})
+			}
+		}
+	}
+}
+
+func verifyRecord(aead cipher.AEAD, hdr Header, data []byte) (int64, error) {
+	data, err := decodePayload(aead, hdr, data)
+	if data == nil {
+		return 0, err
+	}
+
+	var msgid int64
+	var uerr error
+	switch hdr.Type {
+	case MessageRecordType:
+		var msg MessageRecord
+		_, uerr = asn1.Unmarshal(data, &msg)
+		msgid = msg.MessageID
+	case HeaderRecordType:
+		var hr HeaderRecord
+		_, uerr = asn1.Unmarshal(data, &hr)
+		msgid = hr.MessageID
+	case LabelsRecordType:
+		var lbl LabelsRecord
+		_, uerr = asn1.Unmarshal(data, &lbl)
+	case DeleteRecordType:
+		var del DeleteRecord
+		_, uerr = asn1.Unmarshal(data, &del)
+	case IndexRecordType:
+		var idx IndexRecord
+		_, uerr = asn1.Unmarshal(data, &idx)
+	case CheckpointRecordType:
+		var cp CheckpointRecord
+		_, uerr = asn1.Unmarshal(data, &cp)
+	case ScanRecordType:
+		var scan ScanRecord
+		_, uerr = asn1.Unmarshal(data, &scan)
+	case LabelNamesRecordType:
+		var names LabelNamesRecord
+		_, uerr = asn1.Unmarshal(data, &names)
+	case OffsetsRecordType:
+		var offs OffsetsRecord
+		_, uerr = asn1.Unmarshal(data, &offs)
+	}
+	if err == nil {
+		err = uerr
+	}
+	return msgid, err
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/calmh/gmailsync/db"
+	"github.com/calmh/gmailsync/imap"
+)
+
+// doctor checks the configuration, the connection to the server and the
+// vault of the selected accounts step by step, printing the outcome of each
+// step with a hint for fixing those that fail. It returns whether all
+// passed.
+func doctor() bool {
+	ok := true
+	check := func(name string, err error, hint string) bool {
+		if err == nil {
+			fmt.Printf("  PASS  %s\n", name)
+			return true
+		}
+		fmt.Printf("  FAIL  %s: %v\n", name, err)
+		if hint != "" {
+			fmt.Printf("        %s\n", hint)
+		}
+		ok = false
+		return false
+	}
+
+	cfg, err := loadConfig(configFile)
+	if !check("Configuration", err, "") {
+		return false
+	}
+	accounts, err := selectAccounts(cfg, accountName)
+	if !check("Accounts", err, "Add a [gmail] or [account:<name>] section; see the README") {
+		return false
+	}
+
+	for _, acc := range accounts {
+		fmt.Printf("[%s]\n", acc.section)
+		if check("Required settings", acc.check("fetch"), "") {
+			doctorServer(acc, check)
+		}
+		if acc.get("vault") != "" {
+			doctorVault(acc, check)
+		}
+	}
+	return ok
+}
+
+// doctorServer connects to the server of acc, logs in and lists the
+// mailboxes, stopping at the first step that fails.
+func doctorServer(acc *account, check func(string, error, string) bool) {
+	tlsCfg, err := tlsConfig(acc)
+	timeout, terr := imapTimeout(acc)
+	if err == nil {
+		err = terr
+	}
+	if !check("Connection settings", err, "") {
+		return
+	}
+
+	probe, err := imap.Dial(server(acc), tlsCfg, startTLS(acc), timeout)
+	hint := "Check server and port, and that the network allows connections to it"
+	var unknownCA x509.UnknownAuthorityError
+	var wrongHost x509.HostnameError
+	switch {
+	case errors.As(err, &unknownCA):
+		hint = "Set ca_file to the CA certificate the server certificate is signed with"
+	case errors.As(err, &wrongHost):
+		hint = "The certificate is for another host; check server"
+	}
+	if !check("TLS connection to "+server(acc), err, hint) {
+		return
+	}
+	defer probe.Close()
+
+	if acc.tokens != nil {
+		err = probe.LoginOAuth(acc.get("email"), acc.tokens)
+		hint = "Check refresh_token, client_id and client_secret, or oauth_token, and that the token grants the https://mail.google.com/ scope"
+	} else {
+		var password string
+		password, err = acc.password()
+		if err == nil {
+			err = probe.Login(acc.get("email"), password)
+		}
+		hint = "Check email and password; with two factor authentication use an app password from https://myaccount.google.com/apppasswords"
+	}
+	if !check("Login as "+acc.get("email"), err, hint) {
+		return
+	}
+
+	infos, err := probe.Mailboxes()
+	if !check("List mailboxes", err, "") {
+		return
+	}
+	names := imap.MailboxNames(infos)
+	if !probe.Gmail() {
+		fmt.Println("  NOTE  The server lacks the Gmail IMAP extensions; labels will not be synced")
+	}
+	for _, mailbox := range mailboxes(acc) {
+		if mailbox == "" || mailbox == imap.AllMail {
+			name, err := probe.AllMail(mailbox == "")
+			if !check("Mailbox holding all mail", err, "") {
+				continue
+			}
+			mailbox = name
+		}
+		err = nil
+		if !hasString(names, mailbox) {
+			err = errors.New("no such mailbox")
+		}
+		check("Mailbox "+mailbox, err, "Set mailbox to one of "+strings.Join(names, ", "))
+	}
+}
+
+// doctorVault checks that the vault of acc can be read and written, or
+// created if it doesn't exist, without changing it.
+func doctorVault(acc *account, check func(string, error, string) bool) {
+	vault := acc.get("vault")
+	if _, err := os.Stat(vault); os.IsNotExist(err) {
+		// Create a file next to it instead of the vault itself
+		fd, err := ioutil.TempFile(filepath.Dir(vault), ".gmailsync-doctor")
+		if err == nil {
+			fd.Close()
+			os.Remove(fd.Name())
+		}
+		check("Vault "+vault+" can be created", err, "Create the directory, or make it writable by this user")
+		return
+	}
+
+	key, err := acc.encryptionKey()
+	if !check("Encryption key", err, "") {
+		return
+	}
+	// The vault may be in use by a fetch, so it's opened read-only and
+	// its writability checked without writing to it
+	vdb, err := db.OpenReadOnly(vault, key)
+	if err == nil {
+		err = vdb.Close()
+	}
+	if !check("Vault "+vault, err, "Restore it from a backup, or check encryption_key") {
+		return
+	}
+	fd, err := os.OpenFile(vault, os.O_WRONLY, 0)
+	if err == nil {
+		err = fd.Close()
+	}
+	check("Vault "+vault+" is writable", err, "Make the file writable by this user")
+}
+
+func hasString(ss []string, s string) bool {
+	for _, e := range ss {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
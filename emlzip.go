@@ -0,0 +1,146 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/calmh/gmailsync/db"
+)
+
+// emlManifestEntry describes one message in the manifest.json of an
+// eml-zip export.
+type emlManifestEntry struct {
+	MsgID    int64    `json:"msgid"`
+	ThreadID int64    `json:"thread_id,omitempty"`
+	File     string   `json:"file"`
+	Labels   []string `json:"labels"`
+}
+
+// emlZip writes the messages in the vault as <msgid>.eml entries in the zip
+// file name, followed by a manifest.json listing the labels of each. With
+// withSubject the entry names also carry the subject of the message. The
+// file is written under a temporary name and renamed into place when
+// complete.
+func emlZip(vault *db.DB, name string, filter labelFilter, withSubject bool) error {
+	fd, err := createAtomic(name)
+	if err != nil {
+		return err
+	}
+	defer atExit(fd.abort)()
+	zw := zip.NewWriter(fd)
+
+	manifest := []emlManifestEntry{}
+	emitted := make(map[int64]bool)
+	for {
+		rec, err := vault.ReadMessage()
+		if err == io.EOF {
+			break
+		}
+		if _, ok := err.(*db.RecordError); ok {
+			warnf("Skipping %v", err)
+			continue
+		}
+		if err != nil {
+			fd.abort()
+			return err
+		}
+
+		if emitted[rec.MessageID] {
+			// A duplicate copy in the vault
+			continue
+		}
+		emitted[rec.MessageID] = true
+
+		labels := vault.Labels(rec.MessageID)
+		if !filter.match(labels) {
+			continue
+		}
+
+		hdr := &zip.FileHeader{Method: zip.Deflate, Modified: time.Now()}
+		var subject string
+		if msg, err := mail.ReadMessage(bytes.NewReader(rec.Data)); err == nil {
+			if t, err := msg.Header.Date(); err == nil {
+				hdr.Modified = t
+			}
+			subject = msg.Header.Get("Subject")
+			if s, err := new(mime.WordDecoder).DecodeHeader(subject); err == nil {
+				subject = s
+			}
+		}
+		hdr.Name = strconv.FormatInt(rec.MessageID, 10)
+		if s := safeFileName(subject, 60); withSubject && s != "" {
+			hdr.Name += "_" + s
+		}
+		hdr.Name += ".eml"
+
+		wr, err := zw.CreateHeader(hdr)
+		if err != nil {
+			fd.abort()
+			return err
+		}
+		_, err = wr.Write(rec.Data)
+		if err != nil {
+			fd.abort()
+			return err
+		}
+
+		labels = mapping.apply(labels)
+		if labels == nil {
+			labels = []string{}
+		}
+		manifest = append(manifest, emlManifestEntry{rec.MessageID, rec.ThreadID, hdr.Name, labels})
+	}
+
+	wr, err := zw.CreateHeader(&zip.FileHeader{Name: "manifest.json", Method: zip.Deflate, Modified: time.Now()})
+	if err != nil {
+		fd.abort()
+		return err
+	}
+	enc := json.NewEncoder(wr)
+	enc.SetIndent("", "  ")
+	err = enc.Encode(manifest)
+	if err != nil {
+		fd.abort()
+		return err
+	}
+
+	err = zw.Close()
+	if err != nil {
+		fd.abort()
+		return err
+	}
+	err = fd.commit()
+	if err != nil {
+		return err
+	}
+	infof("Wrote %d messages to %s", len(manifest), name)
+	return nil
+}
+
+// safeFileName returns s with everything but letters, digits, dots and
+// dashes replaced by underscores, collapsed and trimmed, and cut to at most
+// max characters.
+func safeFileName(s string, max int) string {
+	var res []rune
+	for _, r := range s {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '.' && r != '-' {
+			r = '_'
+		}
+		if r == '_' && (len(res) == 0 || res[len(res)-1] == '_') {
+			continue
+		}
+		res = append(res, r)
+		if len(res) == max {
+			break
+		}
+	}
+	return strings.Trim(string(res), "_.")
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/calmh/gmailsync/db"
+	"github.com/calmh/gmailsync/syncer"
+)
+
+type mboxFile struct {
+	fd  *os.File
+	bwr *bufio.Writer
+}
+
+// exportByLabel writes one mbox file per label into dir, with each message
+// appearing in the file of every label it carries. Unlabeled messages are
+// written to all.mbox if unlabeled is set. Labels whose file names would be
+// the same, ignoring case, get their own files with a number appended.
+func exportByLabel(vault *db.DB, dir string, filter labelFilter, unlabeled bool) error {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return err
+	}
+
+	files := make(map[string]*mboxFile)
+	defer func() {
+		for _, f := range files {
+			f.fd.Close()
+		}
+	}()
+
+	open := func(name string) (*mboxFile, error) {
+		if f, ok := files[name]; ok {
+			return f, nil
+		}
+		fd, err := os.Create(filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		f := &mboxFile{fd, bufio.NewWriter(fd)}
+		files[name] = f
+		return f, nil
+	}
+
+	fileNames := make(map[string]string)
+	used := make(map[string]bool)
+	if unlabeled {
+		used["all.mbox"] = true
+	}
+	fileName := func(label string) string {
+		if name, ok := fileNames[label]; ok {
+			return name
+		}
+		name := labelFileName(label)
+		base := strings.TrimSuffix(name, ".mbox")
+		for i := 2; used[strings.ToLower(name)]; i++ {
+			name = fmt.Sprintf("%s-%d.mbox", base, i)
+		}
+		if name != labelFileName(label) {
+			warnf("Writing label %s to %s, as %s is taken by another label", label, name, labelFileName(label))
+		}
+		used[strings.ToLower(name)] = true
+		fileNames[label] = name
+		return name
+	}
+
+	var nwritten int
+	emitted := make(map[int64]bool)
+	for {
+		rec, err := vault.ReadMessage()
+		if err == io.EOF {
+			break
+		}
+		if _, ok := err.(*db.RecordError); ok {
+			warnf("Skipping %v", err)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		if emitted[rec.MessageID] {
+			// A duplicate copy in the vault
+			continue
+		}
+		emitted[rec.MessageID] = true
+
+		labels := vault.Labels(rec.MessageID)
+		if !filter.match(labels) {
+			continue
+		}
+
+		labels = mapping.apply(labels)
+		var names []string
+		for _, label := range labels {
+			names = append(names, fileName(label))
+		}
+		if len(names) == 0 && unlabeled {
+			names = []string{"all.mbox"}
+		}
+
+		for _, name := range names {
+			f, err := open(name)
+			if err != nil {
+				return err
+			}
+			syncer.WriteMboxMessage(f.bwr, rec, labels, vault.Flags(rec.MessageID), format)
+		}
+		if len(names) > 0 {
+			nwritten++
+		}
+	}
+
+	for _, f := range files {
+		err := f.bwr.Flush()
+		if err != nil {
+			return err
+		}
+		err = f.fd.Close()
+		if err != nil {
+			return err
+		}
+	}
+	files = nil
+
+	infof("Wrote %d messages to %s", nwritten, dir)
+	return nil
+}
+
+var labelFileReplacer = strings.NewReplacer("/", "_", "\\", "_", ":", "_", "*", "_", "?", "_", "\"", "_", "<", "_", ">", "_", "|", "_")
+
+// labelFileName returns a safe file name for the label, such as
+// "Inbox.mbox" for "\Inbox" and "Work_Projects.mbox" for "Work/Projects".
+func labelFileName(label string) string {
+	name := labelFileReplacer.Replace(strings.TrimPrefix(label, "\\"))
+	name = strings.TrimLeft(name, ".")
+	if name == "" {
+		name = "_"
+	}
+	return name + ".mbox"
+}
+
+// atomicFile is written under a temporary name in the directory of the file
+// and renamed into place by commit, so that an export failing partway
+// leaves no truncated file behind.
+type atomicFile struct {
+	*os.File
+	name string
+}
+
+// createAtomic creates the temporary file for name. It gets the mode of
+// name if that exists, and otherwise 0666 less the umask, as a file
+// created by the shell for "> name" would, rather than the 0600 of
+// ioutil.TempFile.
+func createAtomic(name string) (*atomicFile, error) {
+	dir, base := filepath.Dir(name), filepath.Base(name)
+	for i := 0; ; i++ {
+		tmp := filepath.Join(dir, fmt.Sprintf(".%s.%d.%d", base, os.Getpid(), i))
+		fd, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+		if os.IsExist(err) && i < 10000 {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if fi, err := os.Stat(name); err == nil && fi.Mode().IsRegular() {
+			err = fd.Chmod(fi.Mode().Perm())
+			if err != nil {
+				fd.Close()
+				os.Remove(tmp)
+				return nil, err
+			}
+		}
+		return &atomicFile{fd, name}, nil
+	}
+}
+
+func (f *atomicFile) commit() error {
+	err := f.Sync()
+	if err != nil {
+		f.abort()
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		os.Remove(f.File.Name())
+		return err
+	}
+	return os.Rename(f.File.Name(), f.name)
+}
+
+// abort removes the temporary file.
+func (f *atomicFile) abort() {
+	f.Close()
+	os.Remove(f.File.Name())
+}
@@ -0,0 +1,106 @@
+package imap
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// mailServer returns a function serving a mailbox holding body as the
+// message with UID 7, offering COMPRESS=DEFLATE. It adds one to deflated
+// for each connection compressed.
+func mailServer(body []byte, deflated *int32) func(conn net.Conn) {
+	return func(conn net.Conn) {
+		rd := bufio.NewReader(conn)
+		var wr io.Writer = conn
+		flush := func() error { return nil }
+		reply := func(lines ...string) {
+			io.WriteString(wr, strings.Join(lines, ""))
+			flush()
+		}
+
+		reply("* OK [CAPABILITY IMAP4rev1 COMPRESS=DEFLATE] ready\r\n")
+		for {
+			line, err := rd.ReadString('\n')
+			if err != nil {
+				return
+			}
+			f := strings.SplitN(strings.TrimRight(line, "\r\n"), " ", 2)
+			if len(f) < 2 {
+				return
+			}
+			tag, cmd := f[0], strings.ToUpper(f[1])
+			switch {
+			case strings.HasPrefix(cmd, "CAPABILITY"):
+				reply("* CAPABILITY IMAP4rev1 COMPRESS=DEFLATE\r\n", tag, " OK done\r\n")
+			case strings.HasPrefix(cmd, "COMPRESS DEFLATE"):
+				reply(tag, " OK compressing\r\n")
+				fw, _ := flate.NewWriter(conn, flate.DefaultCompression)
+				wr, flush = fw, fw.Flush
+				rd = bufio.NewReader(flate.NewReader(rd))
+				atomic.AddInt32(deflated, 1)
+			case strings.HasPrefix(cmd, "EXAMINE"), strings.HasPrefix(cmd, "SELECT"):
+				reply("* 1 EXISTS\r\n* OK [UIDVALIDITY 1] ok\r\n", tag, " OK [READ-ONLY] done\r\n")
+			case strings.HasPrefix(cmd, "UID FETCH"):
+				reply(fmt.Sprintf("* 1 FETCH (UID 7 BODY[] {%d}\r\n", len(body)), string(body), ")\r\n", tag, " OK done\r\n")
+			case strings.HasPrefix(cmd, "LOGOUT"):
+				reply("* BYE\r\n", tag, " OK done\r\n")
+				return
+			default:
+				reply(tag, " OK done\r\n")
+			}
+		}
+	}
+}
+
+// TestCompressedFetch checks that a message fetched over a compressed
+// connection is byte for byte the one fetched without compression.
+func TestCompressedFetch(t *testing.T) {
+	var body bytes.Buffer
+	body.WriteString("Subject: compressed\r\n\r\n")
+	for i := 0; i < 256; i++ {
+		body.WriteByte(byte(i))
+	}
+	body.WriteString("\r\n")
+	// Enough text, some of it random, for several deflate blocks
+	rnd := rand.New(rand.NewSource(1))
+	for body.Len() < 256<<10 {
+		fmt.Fprintf(&body, "line %d of %x\r\n", body.Len(), rnd.Uint64())
+	}
+
+	for _, compress := range []bool{false, true} {
+		t.Run(fmt.Sprint("compress=", compress), func(t *testing.T) {
+			var deflated int32
+			addr, cert := tlsServer(t, mailServer(body.Bytes(), &deflated))
+			roots := x509.NewCertPool()
+			roots.AddCert(cert)
+
+			client, err := Client(addr, &tls.Config{RootCAs: roots}, false, compress, 5*time.Second, "user", "secret", "INBOX")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Logout(0)
+			bodies, err := client.GetMails(context.Background(), []uint32{7})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(bodies[7], body.Bytes()) {
+				t.Errorf("fetched %d bytes differing from the %d of the message", len(bodies[7]), body.Len())
+			}
+			if want := map[bool]int32{false: 0, true: 1}[compress]; atomic.LoadInt32(&deflated) != want {
+				t.Errorf("connection compressed %d times, not %d", deflated, want)
+			}
+		})
+	}
+}
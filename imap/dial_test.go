@@ -0,0 +1,114 @@
+package imap
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// tlsServer listens on localhost with a self-signed certificate, handing
+// each connection to serve. It returns the address and the certificate.
+func tlsServer(t *testing.T, serve func(conn net.Conn)) (string, *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "imap.test"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.SetDeadline(time.Now().Add(5 * time.Second))
+				serve(conn)
+			}()
+		}
+	}()
+	return ln.Addr().String(), cert
+}
+
+func TestDialVerifiesCertificate(t *testing.T) {
+	addr, cert := tlsServer(t, func(conn net.Conn) {
+		conn.Write([]byte("* OK [CAPABILITY IMAP4rev1] ready\r\n"))
+		rd := bufio.NewReader(conn)
+		for {
+			line, err := rd.ReadString('\n')
+			if err != nil {
+				return
+			}
+			// A LOGOUT after the connection succeeded
+			tag := strings.SplitN(line, " ", 2)[0]
+			conn.Write([]byte("* BYE\r\n" + tag + " OK done\r\n"))
+		}
+	})
+
+	// A self-signed certificate is refused unless its CA is given
+	_, err := dial(addr, &tls.Config{}, false, 5*time.Second)
+	if err == nil {
+		t.Fatal("connected to a server with a self-signed certificate")
+	}
+	var authErr x509.UnknownAuthorityError
+	if !errors.As(err, &authErr) {
+		t.Errorf("connecting returned %v, not an unknown authority error", err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	for name, cfg := range map[string]*tls.Config{
+		"ca_file":              {RootCAs: roots},
+		"insecure_skip_verify": {InsecureSkipVerify: true},
+	} {
+		cl, err := dial(addr, cfg, false, 5*time.Second)
+		if err != nil {
+			t.Errorf("connecting with %s: %v", name, err)
+			continue
+		}
+		cl.Logout(0)
+	}
+
+	// The certificate is for the address, not another name
+	_, err = dial(addr, &tls.Config{RootCAs: roots, ServerName: "imap.example.com"}, false, 5*time.Second)
+	var hostErr x509.HostnameError
+	if !errors.As(err, &hostErr) {
+		t.Errorf("connecting with the wrong server name returned %v, not a hostname error", err)
+	}
+}
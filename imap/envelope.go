@@ -0,0 +1,134 @@
+package imap
+
+import (
+	"bytes"
+	"context"
+	"strings"
+
+	"code.google.com/p/go-imap/go1/imap"
+)
+
+// Envelope holds the main header fields of a message as returned by the
+// server in the IMAP ENVELOPE structure. Values are as in the original
+// headers, i.e. not decoded.
+type Envelope struct {
+	Date      string
+	Subject   string
+	From      string
+	To        string
+	Cc        string
+	InReplyTo string
+	MessageID string
+	// Size is the size of the complete message
+	Size uint32
+}
+
+// Header returns the envelope formatted as an RFC822 header block.
+func (e Envelope) Header() []byte {
+	var buf bytes.Buffer
+	for _, f := range []struct{ name, value string }{
+		{"Date", e.Date},
+		{"From", e.From},
+		{"To", e.To},
+		{"Cc", e.Cc},
+		{"Subject", e.Subject},
+		{"Message-ID", e.MessageID},
+		{"In-Reply-To", e.InReplyTo},
+	} {
+		if f.value != "" {
+			buf.WriteString(f.name + ": " + f.value + "\r\n")
+		}
+	}
+	buf.WriteString("\r\n")
+	return buf.Bytes()
+}
+
+func (client *IMAPClient) GetEnvelope(ctx context.Context, uid uint32) (*Envelope, error) {
+	var env *Envelope
+	err := client.retry(ctx, func() error {
+		var err error
+		env, err = client.getEnvelope(uid)
+		return err
+	})
+	return env, err
+}
+
+func (client *IMAPClient) getEnvelope(uid uint32) (*Envelope, error) {
+	var set = &imap.SeqSet{}
+	set.AddNum(uid)
+
+	cmd, err := client.wait(client.UIDFetch(set, "ENVELOPE", "RFC822.SIZE"))
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := messageInfo(cmd)
+	if err != nil {
+		return nil, err
+	}
+	fields := imap.AsList(info.Attrs["ENVELOPE"])
+	if len(fields) < 10 {
+		return nil, errBadEnvelope
+	}
+
+	return &Envelope{
+		Date:      imap.AsString(fields[0]),
+		Subject:   imap.AsString(fields[1]),
+		From:      addressList(fields[2]),
+		To:        addressList(fields[5]),
+		Cc:        addressList(fields[6]),
+		InReplyTo: imap.AsString(fields[8]),
+		MessageID: imap.AsString(fields[9]),
+		Size:      info.Size,
+	}, nil
+}
+
+// GetMailSizes returns the sizes of the given messages as reported by the
+// server, keyed by UID, with a single command. Messages no longer in the
+// mailbox are missing from the result.
+func (client *IMAPClient) GetMailSizes(ctx context.Context, uids []uint32) (map[uint32]uint32, error) {
+	var sizes map[uint32]uint32
+	err := client.retry(ctx, func() error {
+		var set = &imap.SeqSet{}
+		set.AddNum(uids...)
+
+		cmd, err := client.wait(client.UIDFetch(set, "UID", "RFC822.SIZE"))
+		if err != nil {
+			return err
+		}
+		sizes = parseSizes(cmd.Data)
+		return nil
+	})
+	return sizes, err
+}
+
+// parseSizes returns the message sizes in the FETCH responses in data, keyed
+// by UID.
+func parseSizes(data []*imap.Response) map[uint32]uint32 {
+	sizes := make(map[uint32]uint32, len(data))
+	for _, rsp := range data {
+		if info := rsp.MessageInfo(); info != nil {
+			sizes[info.UID] = info.Size
+		}
+	}
+	return sizes
+}
+
+// addressList formats an ENVELOPE address list, a list of (name adl
+// mailbox host) tuples, as an RFC822 address list.
+func addressList(f imap.Field) string {
+	var addrs []string
+	for _, af := range imap.AsList(f) {
+		parts := imap.AsList(af)
+		if len(parts) < 4 || parts[3] == nil {
+			// Group syntax markers have a NIL host
+			continue
+		}
+		addr := imap.AsString(parts[2]) + "@" + imap.AsString(parts[3])
+		if name := imap.AsString(parts[0]); name != "" {
+			addr = name + " <" + addr + ">"
+		}
+		addrs = append(addrs, addr)
+	}
+	return strings.Join(addrs, ", ")
+}
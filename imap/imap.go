@@ -1,106 +1,791 @@
 package imap
 
 import (
+	"compress/flate"
+	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
+	"log"
+	"net"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	"code.google.com/p/go-imap/go1/imap"
 )
 
+const DefaultServer = "imap.gmail.com:993"
+
+// DefaultTimeout is the time to wait for the server to respond to a command
+// when no timeout is given.
+const DefaultTimeout = 60 * time.Second
+
+// DefaultMailbox is the name of the mailbox that holds every message on
+// Gmail, selected when none is given and no mailbox has the special-use
+// \All attribute.
+const DefaultMailbox = "[Gmail]/All Mail"
+
+// AllMail selects the mailbox with the special-use \All attribute, under
+// whatever localized name the account has for it.
+const AllMail = "@all"
+
+var errBadEnvelope = errors.New("imap: malformed ENVELOPE")
+
+// ErrNoMessage is returned when a message is not in the mailbox, such as when
+// it was expunged after it was found by a scan.
+var ErrNoMessage = errors.New("imap: message not in the mailbox")
+
 type IMAPClient struct {
-	imap.Client
+	*imap.Client
+	// Gmail is true when the server supports the Gmail IMAP extensions
+	// (X-GM-MSGID, X-GM-LABELS).
+	Gmail bool
+	// Retries is the number of times a command failing due to a lost
+	// connection is retried, after reconnecting.
+	Retries int
+
+	timeout time.Duration
+	connect func() (*imap.Client, error)
 }
 
 type MsgID struct {
 	UID    uint32
 	MsgID  int64
 	Labels []string
+	// ThreadID is the Gmail conversation the message belongs to, or zero
+	ThreadID int64
+	// Flags are the IMAP flags of the message, such as \Seen and \Flagged,
+	// sorted and without \Recent
+	Flags []string
+}
+
+// Client connects to server with TLS, verifying its certificate according
+// to tlsCfg, and logs in with a password. With starttls the connection is
+// made in plain text and upgraded with STARTTLS before logging in, instead
+// of using TLS from the start. With compress the connection is compressed
+// after logging in, if the server supports COMPRESS=DEFLATE. Commands,
+// including connecting and logging in, fail with imap.ErrTimeout if the
+// server doesn't respond within timeout, or DefaultTimeout if zero.
+func Client(server string, tlsCfg *tls.Config, starttls, compress bool, timeout time.Duration, email, password, mailbox string) (*IMAPClient, error) {
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+	return newClient(timeout, func() (*imap.Client, error) {
+		cl, err := dial(server, tlsCfg, starttls, timeout)
+		if err != nil {
+			return nil, err
+		}
+
+		err = login(cl, email, password, timeout)
+		if err != nil {
+			cl.Logout(0)
+			return nil, err
+		}
+		if compress {
+			err = deflate(cl, timeout)
+			if err != nil {
+				cl.Logout(0)
+				return nil, err
+			}
+		}
+
+		return selectMailbox(cl, mailbox, timeout)
+	})
+}
+
+// ClientOAuth is like Client but authenticates using SASL XOAUTH2 with an
+// access token obtained from tokens.
+func ClientOAuth(server string, tlsCfg *tls.Config, starttls, compress bool, timeout time.Duration, email string, tokens TokenSource, mailbox string) (*IMAPClient, error) {
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+	return newClient(timeout, func() (*imap.Client, error) {
+		token, err := tokens.Token()
+		if err != nil {
+			return nil, err
+		}
+
+		cl, err := dial(server, tlsCfg, starttls, timeout)
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = wait(cl, timeout)(cl.Auth(xoauth2{email, token}))
+		if err != nil {
+			cl.Logout(0)
+			return nil, err
+		}
+		if compress {
+			err = deflate(cl, timeout)
+			if err != nil {
+				cl.Logout(0)
+				return nil, err
+			}
+		}
+
+		return selectMailbox(cl, mailbox, timeout)
+	})
 }
 
-func Client(email, password, mailbox string) (*IMAPClient, error) {
-	tlsCfg := tls.Config{
-		InsecureSkipVerify: true,
+// deflate turns on COMPRESS=DEFLATE if the server offers it. If the server
+// refuses, that is logged and the connection stays uncompressed; an error
+// is returned only if the connection can't be used.
+func deflate(cl *imap.Client, timeout time.Duration) error {
+	if !cl.Caps["COMPRESS=DEFLATE"] {
+		return nil
 	}
+	_, err := wait(cl, timeout)(cl.CompressDeflate(flate.DefaultCompression))
+	if err == nil {
+		return nil
+	}
+	if state := cl.State(); state == imap.Closed || state == imap.Logout {
+		return err
+	}
+	log.Printf("IMAP: COMPRESS=DEFLATE failed, continuing uncompressed: %v", err)
+	return nil
+}
 
-	cl, err := imap.DialTLS("imap.gmail.com:993", &tlsCfg)
+// login logs in with LOGIN, falling back to AUTHENTICATE PLAIN if the
+// server refuses LOGIN and offers PLAIN.
+func login(cl *imap.Client, email, password string, timeout time.Duration) error {
+	var err error
+	if !cl.Caps["LOGINDISABLED"] {
+		_, err = wait(cl, timeout)(cl.Login(email, password))
+		if err == nil {
+			return nil
+		}
+		if aerr := loginAdvice(err); aerr != nil {
+			return aerr
+		}
+	}
+	if !cl.Caps["AUTH=PLAIN"] || cl.State() != imap.Login {
+		if err == nil {
+			err = errors.New("Server accepts neither LOGIN nor AUTHENTICATE PLAIN")
+		}
+		return err
+	}
+
+	_, perr := wait(cl, timeout)(cl.Auth(imap.PlainAuth(email, password, "")))
+	if perr == nil {
+		return nil
+	}
+	if aerr := loginAdvice(perr); aerr != nil {
+		return aerr
+	}
+	if err == nil {
+		err = perr
+	}
+	return err
+}
+
+// loginAdvice returns an error telling what to do about a login refused
+// by Gmail for reasons other than a wrong password, or nil.
+func loginAdvice(err error) error {
+	msg := strings.ToLower(err.Error())
+	switch {
+	case strings.Contains(msg, "application-specific password required"):
+		return fmt.Errorf("The account has two factor authentication enabled, so Gmail requires an app password rather than the account password; create one at https://myaccount.google.com/apppasswords and set it as password, or use OAuth (%v)", err)
+	case strings.Contains(msg, "web login required"), strings.Contains(msg, "log in via your web browser"):
+		return fmt.Errorf("Gmail wants the login confirmed in a web browser; sign in to Gmail there and try again, or use an app password or OAuth (%v)", err)
+	}
+	return nil
+}
+
+func newClient(timeout time.Duration, connect func() (*imap.Client, error)) (*IMAPClient, error) {
+	cl, err := connect()
 	if err != nil {
 		return nil, err
 	}
 
-	_, err = cl.Login(email, password)
+	return &IMAPClient{Client: cl, Gmail: cl.Caps["X-GM-EXT-1"], timeout: timeout, connect: connect}, nil
+}
+
+// dial connects to server with TLS, or with starttls in plain text upgraded
+// to TLS, waiting at most timeout for the connection and the server
+// greeting. The connection is never returned without TLS, so credentials
+// are not sent in plain text.
+func dial(server string, tlsCfg *tls.Config, starttls bool, timeout time.Duration) (*imap.Client, error) {
+	host, _, err := net.SplitHostPort(server)
 	if err != nil {
 		return nil, err
 	}
 
-	_, err = cl.Select(mailbox, true)
+	cfg := tlsCfg.Clone()
+	if cfg.ServerName == "" {
+		cfg.ServerName = host
+	}
+	var conn net.Conn
+	if starttls {
+		conn, err = (&net.Dialer{Timeout: timeout}).Dial("tcp", server)
+	} else {
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", server, cfg)
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	go func() {
-		// Discard unilateral server data now and then
-		time.Sleep(1 * time.Second)
-		cl.Data = nil
-	}()
+	cl, err := imap.NewClient(conn, host, timeout)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if starttls {
+		err = startTLS(cl, cfg, timeout)
+		if err != nil {
+			cl.Logout(0)
+			return nil, err
+		}
+	}
+	return cl, nil
+}
 
-	return &IMAPClient{*cl}, nil
+// startTLS upgrades the connection with STARTTLS and asks for the
+// capabilities again, as those announced before may have been forged.
+func startTLS(cl *imap.Client, cfg *tls.Config, timeout time.Duration) error {
+	if !cl.Caps["STARTTLS"] {
+		return errors.New("Server does not offer STARTTLS; refusing to log in without TLS")
+	}
+	_, err := cl.StartTLS(cfg)
+	if err != nil {
+		return err
+	}
+	_, err = wait(cl, timeout)(cl.Capability())
+	return err
 }
 
-func (client *IMAPClient) GetMail(uid uint32) ([]byte, error) {
-	var set = &imap.SeqSet{}
-	set.AddNum(uid)
+func selectMailbox(cl *imap.Client, mailbox string, timeout time.Duration) (*imap.Client, error) {
+	if mailbox == "" || mailbox == AllMail {
+		var err error
+		mailbox, err = allMailbox(cl, mailbox == "", timeout)
+		if err != nil {
+			cl.Logout(0)
+			return nil, err
+		}
+	}
+	_, err := wait(cl, timeout)(cl.Select(mailbox, true))
+	if err != nil {
+		if state := cl.State(); state == imap.Closed || state == imap.Logout {
+			return nil, err
+		}
+		// The server refused the mailbox; say which ones there are
+		infos, lerr := listMailboxes(cl, timeout)
+		cl.Logout(0)
+		if lerr != nil {
+			return nil, err
+		}
+		names := MailboxNames(infos)
+		for _, name := range names {
+			if name == mailbox {
+				// It exists but can't be selected
+				return nil, err
+			}
+		}
+		return nil, fmt.Errorf("No mailbox %q; available mailboxes are %s", mailbox, strings.Join(names, ", "))
+	}
+	cl.Data = nil
+	return cl, nil
+}
 
-	cmd, err := client.UIDFetch(set, "RFC822")
+// MailboxInfo describes a mailbox as listed by the server.
+type MailboxInfo struct {
+	Name string
+	// Delimiter separates the levels of the hierarchy in Name
+	Delimiter string
+	// Attributes are attributes such as \Noselect or the special-use
+	// \All and \Sent, sorted
+	Attributes []string
+}
+
+// MailboxNames returns the names of the mailboxes.
+func MailboxNames(infos []MailboxInfo) []string {
+	var res []string
+	for _, info := range infos {
+		res = append(res, info.Name)
+	}
+	return res
+}
+
+func listMailboxes(cl *imap.Client, timeout time.Duration) ([]MailboxInfo, error) {
+	defer func() { cl.Data = nil }()
+	cmd, err := wait(cl, timeout)(cl.List("", "*"))
 	if err != nil {
 		return nil, err
 	}
 
-	for cmd.InProgress() {
-		err = client.Recv(-1)
+	var res []MailboxInfo
+	for _, rsp := range cmd.Data {
+		info := rsp.MailboxInfo()
+		if info == nil {
+			continue
+		}
+		var attrs []string
+		for attr, set := range info.Attrs {
+			if set {
+				attrs = append(attrs, attr)
+			}
+		}
+		sort.Strings(attrs)
+		res = append(res, MailboxInfo{Name: info.Name, Delimiter: info.Delim, Attributes: attrs})
+	}
+	return res, nil
+}
+
+// allMailbox returns the name of the mailbox holding all messages, marked
+// \All as per RFC 6154, or \AllMail as in the older XLIST responses. If
+// there is none, DefaultMailbox is returned if fallback is set and
+// otherwise an error.
+func allMailbox(cl *imap.Client, fallback bool, timeout time.Duration) (string, error) {
+	infos, err := listMailboxes(cl, timeout)
+	if err != nil {
+		return "", err
+	}
+	for _, info := range infos {
+		for _, attr := range info.Attributes {
+			if attr == `\All` || attr == `\AllMail` {
+				return info.Name, nil
+			}
+		}
+	}
+	if fallback {
+		return DefaultMailbox, nil
+	}
+	return "", errors.New("No mailbox is marked as holding all mail; set mailbox to the name of one, as listed by gmailsync list")
+}
+
+// wait returns a function like imap.Wait, but failing with imap.ErrTimeout
+// when the server sends nothing for timeout while the command is in
+// progress.
+func wait(cl *imap.Client, timeout time.Duration) func(*imap.Command, error) (*imap.Command, error) {
+	return func(cmd *imap.Command, err error) (*imap.Command, error) {
 		if err != nil {
 			return nil, err
 		}
+		for cmd.InProgress() {
+			err = cl.Recv(timeout)
+			if err != nil {
+				return nil, err
+			}
+		}
+		_, err = cmd.Result(imap.OK)
+		return cmd, err
+	}
+}
+
+func (client *IMAPClient) wait(cmd *imap.Command, err error) (*imap.Command, error) {
+	return wait(client.Client, client.timeout)(cmd, err)
+}
+
+// retry runs f, reconnecting and running it again with exponential backoff
+// as long as it fails due to a lost connection, until ctx is cancelled. A
+// command in progress is not interrupted by cancellation.
+func (client *IMAPClient) retry(ctx context.Context, f func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	// Unilateral server data we don't use (EXISTS, EXPUNGE, ...) collects
+	// in Data. The client isn't safe for concurrent use, so it's discarded
+	// here, between commands, rather than in the background.
+	defer client.discardData()
+	err := f()
+	for i := 0; err != nil && i < client.Retries && client.connectionLost(err); i++ {
+		delay := time.Duration(1<<uint(i)) * time.Second
+		if delay > time.Minute {
+			delay = time.Minute
+		}
+		log.Printf("IMAP: %v; reconnecting in %v (retry %d of %d)", err, delay, i+1, client.Retries)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		cl, cerr := client.connect()
+		if cerr != nil {
+			err = cerr
+			continue
+		}
+		client.Client.Logout(0)
+		client.Client = cl
+		err = f()
 	}
+	return err
+}
 
-	resp := cmd.Data[0]
-	body := imap.AsBytes(resp.MessageInfo().Attrs["RFC822"])
+func (client *IMAPClient) discardData() {
+	client.Client.Data = nil
+}
 
-	return body, nil
+func (client *IMAPClient) connectionLost(err error) bool {
+	switch err {
+	case io.EOF, io.ErrUnexpectedEOF, imap.ErrTimeout:
+		return true
+	}
+	if _, ok := err.(net.Error); ok {
+		return true
+	}
+	// The connection is closed after a BYE or a failed reconnect
+	state := client.Client.State()
+	return state == imap.Closed || state == imap.Logout
 }
 
-func (client *IMAPClient) Mailboxes() []string {
-	cmd, err := imap.Wait(client.Client.List("", "*"))
+// Messages are fetched with BODY.PEEK[], which returns the same bytes as
+// RFC822 but unlike it never sets the \Seen flag, even on servers that
+// ignore the mailbox being selected read-only. The response attribute is
+// BODY[].
+const (
+	bodyItem = "BODY.PEEK[]"
+	bodyAttr = "BODY[]"
+)
+
+func (client *IMAPClient) GetMail(ctx context.Context, uid uint32) ([]byte, error) {
+	var body []byte
+	err := client.retry(ctx, func() error {
+		var err error
+		body, err = client.getMail(uid)
+		return err
+	})
+	return body, err
+}
+
+func (client *IMAPClient) getMail(uid uint32) ([]byte, error) {
+	var set = &imap.SeqSet{}
+	set.AddNum(uid)
+
+	cmd, err := client.wait(client.UIDFetch(set, bodyItem))
 	if err != nil {
-		return nil
+		return nil, err
 	}
 
-	var res []string
+	info, err := messageInfo(cmd)
+	if err != nil {
+		return nil, err
+	}
+	return imap.AsBytes(info.Attrs[bodyAttr]), nil
+}
+
+// messageInfo returns the message of the first FETCH response of cmd, or
+// ErrNoMessage if there is none.
+func messageInfo(cmd *imap.Command) (*imap.MessageInfo, error) {
 	for _, rsp := range cmd.Data {
-		res = append(res, rsp.MailboxInfo().Name)
+		if info := rsp.MessageInfo(); info != nil {
+			return info, nil
+		}
 	}
+	return nil, ErrNoMessage
+}
 
-	return res
+// GetMails fetches the given messages with a single command, returning
+// their bodies keyed by UID. Messages no longer in the mailbox are missing
+// from the result.
+func (client *IMAPClient) GetMails(ctx context.Context, uids []uint32) (map[uint32][]byte, error) {
+	var bodies map[uint32][]byte
+	err := client.retry(ctx, func() error {
+		var set = &imap.SeqSet{}
+		set.AddNum(uids...)
+
+		cmd, err := client.wait(client.UIDFetch(set, "UID", bodyItem))
+		if err != nil {
+			return err
+		}
+
+		bodies = parseBodies(cmd.Data)
+		return nil
+	})
+	return bodies, err
+}
+
+// parseBodies returns the message bodies in the FETCH responses in data,
+// keyed by UID.
+func parseBodies(data []*imap.Response) map[uint32][]byte {
+	bodies := make(map[uint32][]byte, len(data))
+	for _, rsp := range data {
+		info := rsp.MessageInfo()
+		if info == nil {
+			continue
+		}
+		bodies[info.UID] = imap.AsBytes(info.Attrs[bodyAttr])
+	}
+	return bodies
+}
+
+// Mailboxes lists the mailboxes on the server.
+func (client *IMAPClient) Mailboxes() ([]MailboxInfo, error) {
+	return listMailboxes(client.Client, client.timeout)
+}
+
+// MsgIDSearch returns the UID, message ID, labels and flags of the messages
+// in the given sequence range. On servers without the Gmail extensions the
+// message ID is derived from the UID and UIDVALIDITY, and there are no
+// labels.
+func (client *IMAPClient) MsgIDSearch(ctx context.Context, first, last uint32) ([]MsgID, error) {
+	return client.search(ctx, first, last, false)
 }
 
-func (client *IMAPClient) MsgIDSearch(first, last uint32) ([]MsgID, error) {
-	ss := fmt.Sprintf("%d:%d", first, last)
-	seq, _ := imap.NewSeqSet(ss)
-	cmd, err := imap.Wait(client.Client.Fetch(seq, "UID", "X-GM-MSGID", "X-GM-LABELS"))
+// UIDMsgIDSearch is like MsgIDSearch but takes a UID range instead of a
+// sequence range.
+func (client *IMAPClient) UIDMsgIDSearch(ctx context.Context, first, last uint32) ([]MsgID, error) {
+	return client.search(ctx, first, last, true)
+}
+
+// SearchDate returns the UIDs of the messages received on or after the date
+// of since and before that of before, by their INTERNALDATE. A zero time
+// leaves that end of the range open.
+func (client *IMAPClient) SearchDate(ctx context.Context, since, before time.Time) ([]uint32, error) {
+	var spec []imap.Field
+	if !since.IsZero() {
+		spec = append(spec, "SINCE", since.Format("2-Jan-2006"))
+	}
+	if !before.IsZero() {
+		spec = append(spec, "BEFORE", before.Format("2-Jan-2006"))
+	}
+	if len(spec) == 0 {
+		spec = append(spec, "ALL")
+	}
+
+	var res []uint32
+	err := client.retry(ctx, func() error {
+		cmd, err := client.wait(client.Client.UIDSearch(spec...))
+		if err != nil {
+			return err
+		}
+		res = nil
+		for _, rsp := range cmd.Data {
+			res = append(res, rsp.SearchResults()...)
+		}
+		return nil
+	})
+	return res, err
+}
+
+// SearchMsgIDs returns the UIDs of the messages with the given message IDs
+// that are in the mailbox. On servers without the Gmail extensions they
+// are derived from the message IDs, which hold the UIDVALIDITY and UID.
+func (client *IMAPClient) SearchMsgIDs(ctx context.Context, msgids []int64) ([]uint32, error) {
+	var res []uint32
+	if !client.Gmail {
+		for _, msgid := range msgids {
+			if uint32(msgid>>32) == client.Mailbox.UIDValidity {
+				res = append(res, uint32(msgid))
+			}
+		}
+		return res, nil
+	}
+
+	// Searched a hundred at a time as X-GM-MSGID a OR X-GM-MSGID b ...,
+	// keeping the commands short
+	for len(msgids) > 0 {
+		n := len(msgids)
+		if n > 100 {
+			n = 100
+		}
+		var spec []imap.Field
+		for i, msgid := range msgids[:n] {
+			if i < n-1 {
+				spec = append(spec, "OR")
+			}
+			spec = append(spec, "X-GM-MSGID", strconv.FormatInt(msgid, 10))
+		}
+		msgids = msgids[n:]
+
+		var found []uint32
+		err := client.retry(ctx, func() error {
+			cmd, err := client.wait(client.Client.UIDSearch(spec...))
+			if err != nil {
+				return err
+			}
+			found = nil
+			for _, rsp := range cmd.Data {
+				found = append(found, rsp.SearchResults()...)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, found...)
+	}
+	return res, nil
+}
+
+func (client *IMAPClient) search(ctx context.Context, first, last uint32, byUID bool) ([]MsgID, error) {
+	var res []MsgID
+	err := client.retry(ctx, func() error {
+		var err error
+		res, err = client.msgIDSearch(first, last, byUID)
+		return err
+	})
+	return res, err
+}
+
+func (client *IMAPClient) msgIDSearch(first, last uint32, byUID bool) ([]MsgID, error) {
+	if first == 0 || last < first {
+		// Not a valid range, and so no messages
+		return nil, nil
+	}
+	seq, err := imap.NewSeqSet(fmt.Sprintf("%d:%d", first, last))
 	if err != nil {
 		return nil, err
 	}
 
+	items := []string{"UID", "FLAGS"}
+	if client.Gmail {
+		items = append(items, "X-GM-MSGID", "X-GM-THRID", "X-GM-LABELS")
+	}
+	fetch := client.Client.Fetch
+	if byUID {
+		fetch = client.Client.UIDFetch
+	}
+
+	cmd, err := client.wait(fetch(seq, items...))
+	if err != nil {
+		return nil, err
+	}
+
+	return parseMsgIDs(cmd.Data, client.Gmail, client.Mailbox.UIDValidity)
+}
+
+// parseMsgIDs returns the message IDs, labels and flags in the FETCH
+// responses in data, as requested by msgIDSearch. It is separate from the
+// command so that it can be exercised with canned server responses.
+func parseMsgIDs(data []*imap.Response, gmail bool, uidValidity uint32) ([]MsgID, error) {
+	validity := int64(uidValidity) << 32
 	var res []MsgID
-	for _, rsp := range cmd.Data {
+	for _, rsp := range data {
 		uid := rsp.MessageInfo().UID
-		msgid, _ := strconv.Atoi(rsp.MessageInfo().Attrs["X-GM-MSGID"].(string))
-		var labels []string
-		for _, lbl := range rsp.MessageInfo().Attrs["X-GM-LABELS"].([]imap.Field) {
-			labels = append(labels, lbl.(string))
+		flags := parseFlags(rsp.MessageInfo().Flags)
+		if !gmail {
+			res = append(res, MsgID{UID: uid, MsgID: validity | int64(uid), Flags: flags})
+			continue
+		}
+
+		attrs := rsp.MessageInfo().Attrs
+		msgid, err := fieldInt64(attrs["X-GM-MSGID"])
+		if err != nil {
+			return nil, fmt.Errorf("X-GM-MSGID of UID %d: %v", uid, err)
+		}
+		thrid, err := fieldInt64(attrs["X-GM-THRID"])
+		if err != nil {
+			return nil, fmt.Errorf("X-GM-THRID of UID %d: %v", uid, err)
 		}
-		res = append(res, MsgID{uid, int64(msgid), labels})
+		labels, err := fieldStrings(attrs["X-GM-LABELS"])
+		if err != nil {
+			return nil, fmt.Errorf("X-GM-LABELS of UID %d: %v", uid, err)
+		}
+		for i, lbl := range labels {
+			// Labels are mailbox names, in modified UTF-7
+			if dec, err := imap.UTF7Decode(lbl); err == nil {
+				labels[i] = dec
+			}
+		}
+		res = append(res, MsgID{uid, msgid, labels, thrid, flags})
 	}
 	return res, nil
 }
+
+// parseFlags returns the flags in fs, sorted so that they compare equal
+// between fetches, leaving out \Recent as it only concerns the session.
+func parseFlags(fs imap.FlagSet) []string {
+	var res []string
+	for flag, set := range fs {
+		if set && !strings.EqualFold(flag, `\Recent`) {
+			res = append(res, flag)
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
+// fieldInt64 returns the value of a numeric field, which depending on its
+// size the parser returns as a number or a string.
+func fieldInt64(f imap.Field) (int64, error) {
+	switch v := f.(type) {
+	case uint32:
+		return int64(v), nil
+	case uint64:
+		return int64(v), nil
+	case int64:
+		return v, nil
+	case string:
+		return strconv.ParseInt(v, 10, 64)
+	case []byte:
+		return strconv.ParseInt(string(v), 10, 64)
+	}
+	return 0, fmt.Errorf("unexpected value %#v", f)
+}
+
+// fieldStrings returns the elements of a list of strings. Elements that look
+// like numbers, such as a label "2012", may be parsed as such.
+func fieldStrings(f imap.Field) ([]string, error) {
+	if f == nil {
+		return nil, nil
+	}
+	list, ok := f.([]imap.Field)
+	if !ok {
+		return nil, fmt.Errorf("unexpected value %#v", f)
+	}
+
+	var res []string
+	for _, e := range list {
+		switch v := e.(type) {
+		case string:
+			res = append(res, v)
+		case []byte:
+			res = append(res, string(v))
+		case uint32:
+			res = append(res, strconv.FormatUint(uint64(v), 10))
+		default:
+			return nil, fmt.Errorf("unexpected element %#v", e)
+		}
+	}
+	return res, nil
+}
+
+// Idle waits with IDLE until the server reports new or expunged messages,
+// ctx is cancelled or max has passed, and returns whether there was such a
+// change. Servers may drop connections idle for 30 minutes, so max should be
+// less than that.
+func (client *IMAPClient) Idle(ctx context.Context, max time.Duration) (bool, error) {
+	if !client.Caps["IDLE"] {
+		return false, errors.New("Server does not support IDLE")
+	}
+	var changed bool
+	err := client.retry(ctx, func() error {
+		var err error
+		changed, err = client.idle(ctx, max)
+		return err
+	})
+	return changed, err
+}
+
+func (client *IMAPClient) idle(ctx context.Context, max time.Duration) (bool, error) {
+	_, err := client.Client.Idle()
+	if err != nil {
+		return false, err
+	}
+
+	var changed bool
+	deadline := time.Now().Add(max)
+	for !changed && ctx.Err() == nil && time.Now().Before(deadline) {
+		// Wake up regularly to notice cancellation and the deadline
+		err = client.Client.Recv(time.Second)
+		if err == imap.ErrTimeout {
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		for _, rsp := range client.Client.Data {
+			switch rsp.Label {
+			case "EXISTS", "EXPUNGE", "FETCH":
+				changed = true
+			}
+		}
+		client.Client.Data = nil
+	}
+
+	_, err = client.wait(client.Client.IdleTerm())
+	return changed, err
+}
@@ -0,0 +1,169 @@
+package imap
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"code.google.com/p/go-imap/go1/imap"
+)
+
+// fetchResponse returns a FETCH response for the message with the given
+// UID, flags and attributes, as the parser decodes it.
+func fetchResponse(uid uint32, flags []string, attrs imap.FieldMap) *imap.Response {
+	info := &imap.MessageInfo{UID: uid, Attrs: attrs, Flags: imap.FlagSet{}}
+	for _, f := range flags {
+		info.Flags[f] = true
+	}
+	return &imap.Response{Label: "FETCH", Decoded: info}
+}
+
+func TestParseMsgIDs(t *testing.T) {
+	cases := []struct {
+		name  string
+		data  []*imap.Response
+		gmail bool
+		want  []MsgID
+		err   bool
+	}{
+		{
+			name: "gmail",
+			data: []*imap.Response{
+				fetchResponse(7, []string{`\Seen`, `\Recent`, `\Flagged`}, imap.FieldMap{
+					"X-GM-MSGID":  "1278455344230334865",
+					"X-GM-THRID":  uint32(42),
+					"X-GM-LABELS": []imap.Field{`\Inbox`, "Work"},
+				}),
+				fetchResponse(9, nil, imap.FieldMap{
+					"X-GM-MSGID": uint32(1000),
+					"X-GM-THRID": "1278455344230334865",
+				}),
+			},
+			gmail: true,
+			want: []MsgID{
+				{UID: 7, MsgID: 1278455344230334865, Labels: []string{`\Inbox`, "Work"}, ThreadID: 42, Flags: []string{`\Flagged`, `\Seen`}},
+				{UID: 9, MsgID: 1000, ThreadID: 1278455344230334865},
+			},
+		},
+		{
+			name: "labels as numbers and bytes",
+			data: []*imap.Response{
+				fetchResponse(1, nil, imap.FieldMap{
+					"X-GM-MSGID":  uint32(1),
+					"X-GM-THRID":  uint32(1),
+					"X-GM-LABELS": []imap.Field{uint32(2012), []byte("Receipts")},
+				}),
+			},
+			gmail: true,
+			want:  []MsgID{{UID: 1, MsgID: 1, ThreadID: 1, Labels: []string{"2012", "Receipts"}}},
+		},
+		{
+			// Labels are in the modified UTF-7 of mailbox names, and
+			// ones that aren't valid in it are kept as they are
+			name: "labels in modified UTF-7",
+			data: []*imap.Response{
+				fetchResponse(1, nil, imap.FieldMap{
+					"X-GM-MSGID":  uint32(1),
+					"X-GM-THRID":  uint32(1),
+					"X-GM-LABELS": []imap.Field{"Projects/Caf&AOk-", "&AMQ-rger &- Co", "Travel 2012", "&ZeVnLIqe-", "Odd&name"},
+				}),
+			},
+			gmail: true,
+			want:  []MsgID{{UID: 1, MsgID: 1, ThreadID: 1, Labels: []string{"Projects/Café", "Ärger & Co", "Travel 2012", "日本語", "Odd&name"}}},
+		},
+		{
+			name: "without Gmail extensions",
+			data: []*imap.Response{
+				fetchResponse(5, []string{`\Answered`}, nil),
+			},
+			want: []MsgID{{UID: 5, MsgID: 3<<32 | 5, Flags: []string{`\Answered`}}},
+		},
+		{
+			name: "missing message ID",
+			data: []*imap.Response{
+				fetchResponse(1, nil, imap.FieldMap{"X-GM-THRID": uint32(1)}),
+			},
+			gmail: true,
+			err:   true,
+		},
+		{
+			name: "labels not a list",
+			data: []*imap.Response{
+				fetchResponse(1, nil, imap.FieldMap{"X-GM-MSGID": uint32(1), "X-GM-THRID": uint32(1), "X-GM-LABELS": "Inbox"}),
+			},
+			gmail: true,
+			err:   true,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := parseMsgIDs(tc.data, tc.gmail, 3)
+			if tc.err {
+				if err == nil {
+					t.Errorf("no error, got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestParseSizes(t *testing.T) {
+	data := []*imap.Response{
+		fetchResponse(1, nil, nil),
+		{Label: "EXISTS"},
+		fetchResponse(3, nil, nil),
+	}
+	data[0].MessageInfo().Size = 1024
+	data[2].MessageInfo().Size = 40 << 20
+	got := parseSizes(data)
+	want := map[uint32]uint32{1: 1024, 3: 40 << 20}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestMessageInfo(t *testing.T) {
+	// A UID FETCH of a message no longer in the mailbox succeeds without
+	// a FETCH response
+	_, err := messageInfo(&imap.Command{Data: []*imap.Response{{Label: "EXPUNGE"}}})
+	if err != ErrNoMessage {
+		t.Errorf("got %v, not ErrNoMessage", err)
+	}
+	want := fetchResponse(2, nil, nil)
+	info, err := messageInfo(&imap.Command{Data: []*imap.Response{{Label: "EXPUNGE"}, want}})
+	if err != nil || info != want.MessageInfo() {
+		t.Errorf("got %v, %v, not the message info of the FETCH response", info, err)
+	}
+}
+
+func TestParseBodies(t *testing.T) {
+	// Fetching BODY.PEEK[] leaves \Seen alone, and the body comes back
+	// as BODY[] as it does for a plain BODY[]
+	if !strings.HasPrefix(bodyItem, "BODY.PEEK[") {
+		t.Errorf("messages are fetched with %s, which sets \\Seen", bodyItem)
+	}
+	if want := strings.Replace(bodyItem, ".PEEK", "", 1); bodyAttr != want {
+		t.Errorf("body is read from %s, not the %s returned for %s", bodyAttr, want, bodyItem)
+	}
+
+	data := []*imap.Response{
+		fetchResponse(4, nil, imap.FieldMap{bodyAttr: []byte("Subject: one\r\n\r\nbody\r\n")}),
+		{Label: "EXISTS"},
+		fetchResponse(7, []string{`\Seen`}, imap.FieldMap{bodyAttr: "Subject: two\r\n\r\nbody\r\n"}),
+	}
+	got := parseBodies(data)
+	want := map[uint32][]byte{
+		4: []byte("Subject: one\r\n\r\nbody\r\n"),
+		7: []byte("Subject: two\r\n\r\nbody\r\n"),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
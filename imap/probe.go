@@ -0,0 +1,64 @@
+package imap
+
+import (
+	"crypto/tls"
+	"time"
+
+	"code.google.com/p/go-imap/go1/imap"
+)
+
+// Probe takes the steps of connecting that Client takes all at once one at
+// a time, so that a failing connection can be diagnosed step by step.
+type Probe struct {
+	cl      *imap.Client
+	timeout time.Duration
+}
+
+// Dial connects to server with TLS or STARTTLS, as Client does, and waits
+// for the server greeting.
+func Dial(server string, tlsCfg *tls.Config, starttls bool, timeout time.Duration) (*Probe, error) {
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+	cl, err := dial(server, tlsCfg, starttls, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &Probe{cl, timeout}, nil
+}
+
+// Gmail returns whether the server supports the Gmail IMAP extensions.
+func (p *Probe) Gmail() bool {
+	return p.cl.Caps["X-GM-EXT-1"]
+}
+
+// Login logs in with a password, as Client does.
+func (p *Probe) Login(email, password string) error {
+	return login(p.cl, email, password, p.timeout)
+}
+
+// LoginOAuth logs in with SASL XOAUTH2, as ClientOAuth does.
+func (p *Probe) LoginOAuth(email string, tokens TokenSource) error {
+	token, err := tokens.Token()
+	if err != nil {
+		return err
+	}
+	_, err = wait(p.cl, p.timeout)(p.cl.Auth(xoauth2{email, token}))
+	return err
+}
+
+// Mailboxes lists the mailboxes on the server.
+func (p *Probe) Mailboxes() ([]MailboxInfo, error) {
+	return listMailboxes(p.cl, p.timeout)
+}
+
+// AllMail returns the name of the mailbox that Client selects for an empty
+// mailbox name, if fallback is set, or for AllMail otherwise.
+func (p *Probe) AllMail(fallback bool) (string, error) {
+	return allMailbox(p.cl, fallback, p.timeout)
+}
+
+// Close logs out and closes the connection.
+func (p *Probe) Close() {
+	p.cl.Logout(p.timeout)
+}
@@ -0,0 +1,30 @@
+package imap
+
+import "code.google.com/p/go-imap/go1/imap"
+
+type TokenSource interface {
+	Token() (string, error)
+}
+
+// StaticToken is a TokenSource that always returns the same access token.
+type StaticToken string
+
+func (t StaticToken) Token() (string, error) {
+	return string(t), nil
+}
+
+type xoauth2 struct {
+	email string
+	token string
+}
+
+func (a xoauth2) Start(s *imap.ServerInfo) (string, []byte, error) {
+	ir := "user=" + a.email + "\x01auth=Bearer " + a.token + "\x01\x01"
+	return "XOAUTH2", []byte(ir), nil
+}
+
+func (a xoauth2) Next(challenge []byte) ([]byte, error) {
+	// On failure the server sends a JSON error description as a
+	// challenge; an empty response makes it complete the command with NO.
+	return []byte{}, nil
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"net/mail"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/calmh/gmailsync/db"
+	"github.com/calmh/gmailsync/syncer"
+)
+
+// importMbox adds the messages in the mbox file name to the vault, read by
+// syncer.ReadMbox with the given quoting. Messages whose Message-ID header
+// matches a message already in the vault are skipped.
+func importMbox(vault *db.DB, name string, mboxo bool) error {
+	fd, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	known, err := headerMessageIDs(vault)
+	if err != nil {
+		return err
+	}
+
+	var nimported, nskipped int
+	store := func(lines [][]byte) error {
+		rec, labels := parseMboxMessage(lines)
+		msgid, data := rec.MessageID, rec.Data
+
+		hdrID := messageIDHeader(data)
+		if vault.HaveUID(msgid) || hdrID != "" && known[hdrID] {
+			nskipped++
+			return nil
+		}
+		if hdrID != "" {
+			known[hdrID] = true
+		}
+
+		err := vault.WriteMessageRecord(rec)
+		if err != nil {
+			return err
+		}
+		if len(labels) > 0 {
+			vault.SetLabels(msgid, labels)
+		}
+		nimported++
+		return nil
+	}
+
+	err = syncer.ReadMbox(fd, mboxo, store)
+	if err != nil {
+		return err
+	}
+
+	err = vault.WriteLabels()
+	if err != nil {
+		return err
+	}
+	if vault.Unindexed() >= syncer.IndexInterval {
+		err = vault.WriteIndex()
+		if err != nil {
+			return err
+		}
+	}
+
+	infof("Imported %d messages, skipped %d already in the vault", nimported, nskipped)
+	return nil
+}
+
+// parseMboxMessage returns the record and labels of the message made up of
+// lines. The X-Gmail-MsgID, X-GM-Thread-Id and X-Gmail-Labels headers added
+// by mbox are removed and used for the message ID, thread ID and labels;
+// without a message ID one is derived from the message. The data has CRLF
+// line endings, as messages fetched from Gmail do.
+func parseMboxMessage(lines [][]byte) (db.MessageRecord, []string) {
+	if n := len(lines); n > 0 && len(lines[n-1]) == 0 {
+		// The blank line before the next message
+		lines = lines[:n-1]
+	}
+
+	var msgid, thrid int64
+	var labels []string
+	var buf bytes.Buffer
+	inHeader, skipping := true, false
+	for _, line := range lines {
+		if inHeader {
+			if len(line) == 0 {
+				inHeader = false
+			} else if line[0] == ' ' || line[0] == '\t' {
+				if skipping {
+					continue
+				}
+			} else {
+				skipping = false
+				name, value := line, []byte(nil)
+				if i := bytes.IndexByte(line, ':'); i >= 0 {
+					name, value = line[:i], line[i+1:]
+				}
+				switch strings.ToLower(string(name)) {
+				case "x-gmail-msgid":
+					msgid, _ = strconv.ParseInt(strings.TrimSpace(string(value)), 10, 64)
+					skipping = true
+					continue
+				case "x-gm-thread-id":
+					thrid, _ = strconv.ParseInt(strings.TrimSpace(string(value)), 10, 64)
+					skipping = true
+					continue
+				case "x-gmail-labels":
+					for _, label := range strings.Split(string(value), ",") {
+						if label = strings.TrimSpace(label); label != "" {
+							labels = append(labels, label)
+						}
+					}
+					skipping = true
+					continue
+				}
+			}
+		}
+		buf.Write(line)
+		buf.WriteString("\r\n")
+	}
+
+	data := buf.Bytes()
+	if msgid == 0 {
+		msgid = syntheticMessageID(data)
+	}
+	return db.MessageRecord{MessageID: msgid, Data: data, ThreadID: thrid}, labels
+}
+
+// syntheticMessageID derives a message ID for a message without one from
+// its Message-ID header, or its contents if it has none. Synthetic IDs are
+// negative, so they can't collide with those assigned by the server.
+func syntheticMessageID(data []byte) int64 {
+	key := []byte(messageIDHeader(data))
+	if len(key) == 0 {
+		key = data
+	}
+	sum := sha256.Sum256(key)
+	return -int64(binary.BigEndian.Uint64(sum[:8])>>1) - 1
+}
+
+func messageIDHeader(data []byte) string {
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(msg.Header.Get("Message-Id"))
+}
+
+// headerMessageIDs returns the set of Message-ID headers of the messages in
+// the vault.
+func headerMessageIDs(vault *db.DB) (map[string]bool, error) {
+	ids := make(map[string]bool)
+	defer vault.Rewind()
+	for {
+		rec, err := vault.ReadMessage()
+		if err == io.EOF {
+			return ids, nil
+		}
+		if _, ok := err.(*db.RecordError); ok {
+			warnf("Skipping %v", err)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if id := messageIDHeader(rec.Data); id != "" {
+			ids[id] = true
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// stringList is a flag.Value collecting the values of a repeated flag.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+// labelFilter selects messages having any of the include labels (or all
+// messages, if there are none) and none of the exclude labels.
+type labelFilter struct {
+	include stringList
+	exclude stringList
+}
+
+func (f labelFilter) match(labels []string) bool {
+	if hasAnyLabel(labels, f.exclude) {
+		return false
+	}
+	return len(f.include) == 0 || hasAnyLabel(labels, f.include)
+}
+
+func hasAnyLabel(labels, wanted []string) bool {
+	for _, l := range labels {
+		for _, w := range wanted {
+			if normalizeLabel(l) == normalizeLabel(w) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// normalizeLabel makes "\Important", "important" and "IMPORTANT" compare
+// equal.
+func normalizeLabel(l string) string {
+	return strings.ToLower(strings.TrimPrefix(l, "\\"))
+}
+
+// labelMap rewrites label names on export. Labels are looked up normalized,
+// as by labelFilter, and a label mapped to the empty string is dropped.
+// Labels not in the map pass through unchanged, or without the leading
+// backslash of a system label if strip is set.
+type labelMap struct {
+	names map[string]string
+	strip bool
+}
+
+// add adds a mapping given as from=to.
+func (m *labelMap) add(s string) error {
+	eq := strings.Index(s, "=")
+	if eq <= 0 {
+		return errors.New("Expected label=name, not " + strconv.Quote(s))
+	}
+	if m.names == nil {
+		m.names = make(map[string]string)
+	}
+	m.names[normalizeLabel(strings.TrimSpace(s[:eq]))] = strings.TrimSpace(s[eq+1:])
+	return nil
+}
+
+// apply returns labels as renamed by the map, without duplicates.
+func (m labelMap) apply(labels []string) []string {
+	if len(m.names) == 0 && !m.strip {
+		return labels
+	}
+	res := make([]string, 0, len(labels))
+	seen := make(map[string]bool)
+	for _, l := range labels {
+		name, ok := m.names[normalizeLabel(l)]
+		if !ok && m.strip {
+			name = strings.TrimPrefix(l, "\\")
+		} else if !ok {
+			name = l
+		}
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		res = append(res, name)
+	}
+	return res
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+)
+
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+// minLevel is the lowest level that is logged
+var minLevel = levelInfo
+
+func (l *logLevel) String() string {
+	return levelNames[*l]
+}
+
+func (l *logLevel) Set(s string) error {
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			*l = logLevel(i)
+			return nil
+		}
+	}
+	return errors.New("log level must be one of " + strings.Join(levelNames, ", "))
+}
+
+func logf(level logLevel, format string, v ...interface{}) {
+	if level < minLevel {
+		return
+	}
+	msg := fmt.Sprintf(format, v...)
+	if level != levelInfo {
+		// Info is the default and left untagged
+		msg = strings.ToUpper(levelNames[level]) + ": " + msg
+	}
+	log.Output(3, msg)
+}
+
+func debugf(format string, v ...interface{}) { logf(levelDebug, format, v...) }
+func infof(format string, v ...interface{})  { logf(levelInfo, format, v...) }
+func warnf(format string, v ...interface{})  { logf(levelWarn, format, v...) }
+func errorf(format string, v ...interface{}) { logf(levelError, format, v...) }
+
+// logger passes the log output of a syncer.Syncer on to the log functions
+// above.
+type logger struct{}
+
+func (logger) Debugf(format string, v ...interface{}) { logf(levelDebug, format, v...) }
+func (logger) Infof(format string, v ...interface{})  { logf(levelInfo, format, v...) }
+func (logger) Warnf(format string, v ...interface{})  { logf(levelWarn, format, v...) }
+
+// fatal logs v at error level and exits after running the cleanup
+// functions.
+func fatal(v ...interface{}) {
+	logf(levelError, "%s", fmt.Sprint(v...))
+	exit(1)
+}
+
+func fatalf(format string, v ...interface{}) {
+	logf(levelError, format, v...)
+	exit(1)
+}
+
+var cleanups struct {
+	sync.Mutex
+	next  int
+	funcs map[int]func()
+	once  sync.Once
+}
+
+// atExit registers f to be run by exit, for example to leave the vault in a
+// consistent state. The returned function unregisters it again.
+func atExit(f func()) func() {
+	defer cleanups.Unlock()
+	cleanups.Lock()
+	if cleanups.funcs == nil {
+		cleanups.funcs = make(map[int]func())
+	}
+	id := cleanups.next
+	cleanups.next++
+	cleanups.funcs[id] = f
+	return func() {
+		defer cleanups.Unlock()
+		cleanups.Lock()
+		delete(cleanups.funcs, id)
+	}
+}
+
+// exit runs the registered cleanup functions and exits with the given
+// status.
+func exit(code int) {
+	cleanups.once.Do(func() {
+		cleanups.Lock()
+		funcs := cleanups.funcs
+		cleanups.funcs = nil
+		cleanups.Unlock()
+		for _, f := range funcs {
+			f()
+		}
+	})
+	os.Exit(code)
+}
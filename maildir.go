@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/calmh/gmailsync/db"
+)
+
+// maildir writes all messages as individual files into the Maildir at dir.
+// Messages with flags go into cur/ with the flags in the info suffix, and
+// the others into new/. File names are derived from the message ID, so
+// messages already present in either new/ or cur/ are skipped on subsequent
+// runs.
+func maildir(vault *db.DB, dir string, filter labelFilter) error {
+	for _, sub := range []string{"cur", "new", "tmp"} {
+		err := os.MkdirAll(filepath.Join(dir, sub), 0700)
+		if err != nil {
+			return err
+		}
+	}
+
+	var nwritten, nskipped int
+	for {
+		rec, err := vault.ReadMessage()
+		if err == io.EOF {
+			break
+		}
+		if _, ok := err.(*db.RecordError); ok {
+			warnf("Skipping %v", err)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		labels := vault.Labels(rec.MessageID)
+		if !filter.match(labels) {
+			continue
+		}
+
+		name := strconv.FormatInt(rec.MessageID, 10) + ".gmailsync"
+		if maildirHas(dir, name) {
+			nskipped++
+			continue
+		}
+
+		tmp := filepath.Join(dir, "tmp", name)
+		err = writeMaildirFile(tmp, rec.MessageID, mapping.apply(labels), rec.Data)
+		if err != nil {
+			os.Remove(tmp)
+			return err
+		}
+		dst := filepath.Join(dir, "new", name)
+		if flags := maildirFlags(vault.Flags(rec.MessageID)); flags != "" {
+			dst = filepath.Join(dir, "cur", name+":2,"+flags)
+		}
+		err = os.Rename(tmp, dst)
+		if err != nil {
+			return err
+		}
+
+		nwritten++
+	}
+
+	infof("Wrote %d messages to %s (%d already present)", nwritten, dir, nskipped)
+	return nil
+}
+
+func maildirHas(dir, name string) bool {
+	if _, err := os.Stat(filepath.Join(dir, "new", name)); err == nil {
+		return true
+	}
+	matches, _ := filepath.Glob(filepath.Join(dir, "cur", name+":2,*"))
+	return len(matches) > 0
+}
+
+// maildirFlags returns the Maildir info flags for the IMAP flags, in the
+// ASCII order Maildir requires.
+func maildirFlags(flags []string) string {
+	var res string
+	for _, f := range []struct {
+		flag   string
+		letter string
+	}{{`\Draft`, "D"}, {`\Flagged`, "F"}, {`\Answered`, "R"}, {`\Seen`, "S"}, {`\Deleted`, "T"}} {
+		for _, flag := range flags {
+			if strings.EqualFold(flag, f.flag) {
+				res += f.letter
+				break
+			}
+		}
+	}
+	return res
+}
+
+func writeMaildirFile(name string, msgid int64, labels []string, data []byte) error {
+	fd, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+
+	bwr := bufio.NewWriter(fd)
+	if len(labels) > 0 {
+		bwr.WriteString("X-Keywords: " + strings.Join(labels, ",") + "\n")
+	}
+	bwr.WriteString("X-Gmail-MsgID: " + strconv.FormatInt(msgid, 10) + "\n")
+	bwr.Write(bytes.Replace(data, []byte("\r\n"), []byte("\n"), -1))
+
+	err = bwr.Flush()
+	if err != nil {
+		fd.Close()
+		return err
+	}
+	err = fd.Sync()
+	if err != nil {
+		fd.Close()
+		return err
+	}
+	return fd.Close()
+}
@@ -1,53 +1,138 @@
 package main
 
 import (
-	"bufio"
-	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
+	"net"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
-	"sync"
+	"syscall"
 	"time"
 
 	"github.com/calmh/gmailsync/db"
 	"github.com/calmh/gmailsync/imap"
-	"github.com/calmh/ini"
+	"github.com/calmh/gmailsync/oauth"
+	"github.com/calmh/gmailsync/syncer"
 )
 
 var (
-	configFile string = "/etc/gmailsync.ini"
-	traceImap  bool
+	configFile  string = "/etc/gmailsync.ini"
+	vaultPath   string
+	initConfig  bool
+	showVersion bool
+	traceImap   bool
+	logFile     string
+	fullScan    bool
+	fetchSince  dateValue
+	headersOnly bool
+	newestFirst bool
+	maxDuration time.Duration
+	strict      bool
+	prune       bool
+	dryRun      bool
+	quiet       bool
+	reportEvery time.Duration
+	metricsAddr string
+	filter      labelFilter
+	unlabeled   bool
+	emlSubject  bool
+	outFile     string
+	gzipOutput  bool
+	jsonOutput  bool
+	parseMsgs   bool
+	sinceMsgID  int64
+	accountName string
+	withLabels  bool
+	mapLabels   stringList
+	mapping     labelMap
+	format      syncer.MboxFormat
+	mboxFormat  = "mboxrd"
+	query       searchQuery
+	msgIDs      = make(msgIDList)
 )
 
-var progress struct {
-	sync.Mutex
-	toScan  int
-	scanned int
-	fetched int
-	labels  int
-}
-
-type MsgID struct {
-	UID   uint32
-	MsgID int64
-}
-
 func main() {
 	fs := flag.NewFlagSet("gmailsync", flag.ExitOnError)
 	fs.StringVar(&configFile, "cfg", configFile, "Configuration file name")
-	fs.BoolVar(&traceImap, "trace-imap", traceImap, "Verbose trace IMAP operations")
+	fs.BoolVar(&initConfig, "init", initConfig, "Write an example configuration file to the -cfg path and exit")
+	fs.BoolVar(&showVersion, "version", showVersion, "Print the version and exit")
+	fs.StringVar(&accountName, "account", accountName, "Account to use, instead of all configured accounts")
+	fs.StringVar(&vaultPath, "vault", vaultPath, "Vault file to use, instead of the vault of the account in the configuration")
+	fs.BoolVar(&traceImap, "trace-imap", traceImap, "Verbose trace IMAP operations (same as -log-level debug)")
+	fs.Var(&minLevel, "log-level", "Lowest level to log: debug, info, warn or error")
+	fs.StringVar(&logFile, "log-file", logFile, "Append log output to this file instead of stderr")
+	fs.BoolVar(&fullScan, "full", fullScan, "Rescan the whole mailbox instead of resuming after the last synced message")
+	fs.Var(&fetchSince, "since", "Fetch only messages received on or after this date (YYYY-MM-DD)")
+	fs.BoolVar(&headersOnly, "headers-only", headersOnly, "Fetch only the headers of new messages")
+	fs.BoolVar(&newestFirst, "newest-first", newestFirst, "Scan and fetch the newest messages first")
+	fs.BoolVar(&strict, "strict", strict, "Stop fetch at the first message that fails to fetch, instead of skipping it")
+	fs.DurationVar(&maxDuration, "max-duration", maxDuration, "Stop fetching after this long, resuming on the next run (e.g. 30m)")
+	fs.BoolVar(&dryRun, "dry-run", dryRun, "Count the messages fetch would download and the label changes, without changing the vault")
+	fs.BoolVar(&quiet, "quiet", quiet, "Do not report fetch progress")
+	fs.DurationVar(&reportEvery, "progress-interval", reportEvery, "How often to report fetch progress (default 1s on a terminal, 10s otherwise)")
+	fs.StringVar(&metricsAddr, "metrics-addr", metricsAddr, "Serve fetch counters for Prometheus at /metrics on this address (e.g. :9090)")
+	fs.BoolVar(&prune, "prune", prune, "Remove messages no longer in the mailbox from the vault (implies -full)")
+	fs.Var(&filter.include, "label", "Export only messages with this label (repeatable)")
+	fs.Var(&filter.exclude, "not-label", "Do not export messages with this label (repeatable)")
+	fs.Var(msgIDs, "msgid", "Export only the messages with these message IDs in mbox (repeatable, comma separated)")
+	fs.StringVar(&query.from, "from", "", "Search for messages from this sender")
+	fs.StringVar(&query.to, "to", "", "Search for messages to this recipient")
+	fs.StringVar(&query.subject, "subject", "", "Search for messages with this in the subject")
+	fs.StringVar(&query.body, "body", "", "Search for messages with this in the body")
+	fs.Var(&query.before, "before", "Search for messages sent before this date, or fetch only messages received before it (YYYY-MM-DD)")
+	fs.Var(&query.after, "after", "Search for messages sent after this date (YYYY-MM-DD)")
+	fs.BoolVar(&format.CRLF, "crlf", format.CRLF, "Use CRLF line endings in mbox output, as in the original messages")
+	fs.BoolVar(&format.ContentLength, "content-length", format.ContentLength, "Add a Content-Length header to each message in mbox output (mboxcl2)")
+	fs.BoolVar(&format.Raw, "raw", format.Raw, "Write messages in mbox output as stored, without added headers or changed line endings")
+	fs.StringVar(&mboxFormat, "mbox-format", mboxFormat, "Quoting of \"From \" lines in mbox output and import-mbox input: mboxrd or mboxo")
+	fs.StringVar(&outFile, "o", outFile, "Write mbox output to this file, replacing it once complete, instead of stdout")
+	fs.BoolVar(&gzipOutput, "gzip", gzipOutput, "Compress mbox output with gzip")
+	fs.Int64Var(&sinceMsgID, "since-msgid", sinceMsgID, "Export only messages with a higher message ID in mbox")
+	fs.BoolVar(&jsonOutput, "json", jsonOutput, "Print stats as JSON")
+	fs.BoolVar(&withLabels, "with-labels", withLabels, "Prepend the labels and message ID as headers in get")
+	fs.BoolVar(&parseMsgs, "parse", parseMsgs, "Include parsed headers in ndjson output")
+	fs.Var(&mapLabels, "map-label", "Rename a label on export, as label=name; an empty name drops it (repeatable)")
+	fs.BoolVar(&unlabeled, "unlabeled", unlabeled, "Write unlabeled messages to all.mbox in export-by-label")
+	fs.BoolVar(&emlSubject, "eml-subject", emlSubject, "Include the subject in the file names written by eml-zip")
 	fs.Usage = func() {
 		fmt.Println("Usage:")
 		fmt.Println("  gmailsync [options] <command>")
 		fmt.Println()
 		fmt.Println("Command is one of:")
-		fmt.Println("  fetch - Fetch new mail from GMail")
-		fmt.Println("  mbox  - Write an MBOX file with all messages to stdout")
-		fmt.Println("  list  - List available mailboxes")
+		fmt.Println("  fetch         - Fetch new mail from GMail")
+		fmt.Println("  backfill      - Fetch the bodies of messages stored headers only")
+		fmt.Println("  daemon        - Fetch, then keep fetching new mail as it arrives")
+		fmt.Println("  mbox          - Write an MBOX file with all messages to stdout")
+		fmt.Println("  ndjson        - Write all messages as JSON lines to stdout")
+		fmt.Println("  search        - List the messages matching -from, -to, -subject, -body,")
+		fmt.Println("                  -before and -after")
+		fmt.Println("  get <msgid>   - Write a single message to stdout")
+		fmt.Println("  maildir <dir> - Write all messages to a Maildir")
+		fmt.Println("  export-by-label <dir>")
+		fmt.Println("                - Write one MBOX file per label into a directory")
+		fmt.Println("  eml-zip <file>")
+		fmt.Println("                - Write a zip file with one .eml file per message and a")
+		fmt.Println("                  manifest.json of their labels")
+		fmt.Println("  import-mbox <file>")
+		fmt.Println("                - Add the messages in an MBOX file to the vault")
+		fmt.Println("  list          - List available mailboxes")
+		fmt.Println("  compact       - Rewrite the vault without superseded labels")
+		fmt.Println("  dedupe        - Rewrite the vault without duplicate copies of messages")
+		fmt.Println("  verify        - Check the integrity of all records in the vault")
+		fmt.Println("  stats         - Print a summary of the vault contents")
+		fmt.Println("  doctor        - Check the configuration, the connection to the server")
+		fmt.Println("                  and the vault, suggesting fixes for what fails")
+		fmt.Println("  version       - Print the version, commit, Go version and vault format")
 		fmt.Println()
 		fmt.Println("Options (with default values):")
 		fs.PrintDefaults()
@@ -58,250 +143,862 @@ func main() {
 	err := fs.Parse(os.Args[1:])
 	operation := fs.Arg(0)
 
+	if traceImap {
+		minLevel = levelDebug
+	}
+	if logFile != "" {
+		f, err := os.OpenFile(logFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			fatal(err)
+		}
+		log.SetOutput(f)
+	}
+
+	switch mboxFormat {
+	case "mboxrd":
+	case "mboxo":
+		format.Mboxo = true
+	default:
+		fatalf("-mbox-format must be mboxrd or mboxo, not %q", mboxFormat)
+	}
+	if format.Raw && (format.CRLF || format.ContentLength) {
+		fatal("-raw can't be combined with -crlf or -content-length")
+	}
+
+	if showVersion || operation == "version" {
+		printVersion()
+		return
+	}
+
+	if initConfig {
+		err := writeExampleConfig(configFile)
+		if os.IsExist(err) {
+			fatalf("%s already exists; not overwriting it", configFile)
+		}
+		if err != nil {
+			fatal(err)
+		}
+		infof("Wrote example configuration to %s", configFile)
+		return
+	}
+
 	switch operation {
-	case "list", "fetch", "mbox":
+	case "list", "fetch", "backfill", "daemon", "mbox", "ndjson", "search", "compact", "dedupe", "verify", "stats", "doctor":
+	case "get", "maildir", "export-by-label", "eml-zip", "import-mbox":
+		if fs.NArg() != 2 {
+			fs.Usage()
+			os.Exit(1)
+		}
 	default:
 		fs.Usage()
 		os.Exit(1)
 	}
 
-	f, err := os.Open(configFile)
+	if operation == "doctor" {
+		if !doctor() {
+			os.Exit(1)
+		}
+		return
+	}
+
+	cfg, err := loadConfig(configFile)
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
+	}
+
+	accounts, err := selectAccounts(cfg, accountName)
+	if err != nil {
+		fatal(err)
+	}
+	for _, acc := range accounts {
+		err := acc.check(operation)
+		if err != nil {
+			fatal(err)
+		}
+	}
+
+	switch operation {
+	case "daemon", "mbox", "ndjson", "search", "get", "maildir", "export-by-label", "eml-zip", "import-mbox":
+		if len(accounts) > 1 {
+			fatal("Multiple accounts configured; select one with -account")
+		}
+		mapping, err = labelMapping(accounts[0])
+		if err != nil {
+			fatal(err)
+		}
 	}
-	cfg := ini.Parse(f)
-	f.Close()
 
 	switch operation {
 	case "list":
-		email := cfg.Get("gmail", "email")
-		password := cfg.Get("gmail", "password")
-		mailbox := cfg.Get("gmail", "mailbox")
-		cl, _ := imap.Client(email, password, mailbox)
-		mailboxes := cl.Mailboxes()
-		for _, mb := range mailboxes {
-			fmt.Println(mb)
+		for _, acc := range accounts {
+			cl, err := connect(acc, mailboxes(acc)[0])
+			if err != nil {
+				fatal(err)
+			}
+			if len(accounts) > 1 {
+				fmt.Printf("[%s]\n", acc.name)
+			}
+			mailboxes, err := cl.Mailboxes()
+			if err != nil {
+				fatal(err)
+			}
+			for _, mb := range mailboxes {
+				if len(mb.Attributes) > 0 {
+					fmt.Printf("%s\t%s\n", mb.Name, strings.Join(mb.Attributes, " "))
+				} else {
+					fmt.Println(mb.Name)
+				}
+			}
+		}
+
+	case "fetch", "backfill", "daemon":
+		go showProgress()
+		if metricsAddr != "" {
+			err := serveMetrics(metricsAddr)
+			if err != nil {
+				fatal(err)
+			}
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			<-sigs
+			infof("Interrupted; finishing messages in progress (interrupt again to quit now)")
+			cancel()
+			<-sigs
+			os.Exit(1)
+		}()
+		if maxDuration > 0 {
+			time.AfterFunc(maxDuration, func() {
+				infof("Reached -max-duration %v; finishing messages in progress", maxDuration)
+				cancel()
+			})
 		}
 
-	case "fetch":
-		log.Println("Scanning & validating database")
-		db, err := db.Open(cfg.Get("gmail", "vault"))
+		if operation == "daemon" {
+			daemon(ctx, accounts[0])
+			break
+		}
+		for _, acc := range accounts {
+			if ctx.Err() != nil {
+				break
+			}
+			fetch(ctx, acc, fullScan, operation == "backfill")
+		}
+
+	case "mbox":
+		db, err := openVaultReadOnly(accounts[0])
 		if err != nil {
-			log.Fatal(err)
+			fatal(err)
 		}
 
-		log.Printf("Have %d messages", db.Size())
+		var wr io.Writer = os.Stdout
+		dest := "stdout"
+		var out *atomicFile
+		if outFile != "" {
+			out, err = createAtomic(outFile)
+			if err != nil {
+				fatal(err)
+			}
+			defer atExit(out.abort)()
+			wr, dest = out, outFile
+		}
+		var gz *gzip.Writer
+		if gzipOutput {
+			gz = gzip.NewWriter(wr)
+			wr = gz
+		}
 
-		maxConnections := 4
-		if s := cfg.Get("gmail", "connections"); s != "" {
-			v, err := strconv.Atoi(s)
-			if err == nil {
-				maxConnections = v
+		s := &syncer.Syncer{Vault: db, Log: logger{}}
+		res, err := s.Export(wr, syncer.ExportOptions{Filter: filter.match, MapLabels: mapping.apply, SinceMsgID: sinceMsgID, MsgIDs: msgIDs, Format: format})
+		if err != nil {
+			fatal(err)
+		}
+		if gz != nil {
+			err = gz.Close()
+			if err != nil {
+				fatal(err)
+			}
+		}
+		if out != nil {
+			err = out.commit()
+			if err != nil {
+				fatal(err)
 			}
 		}
-		if maxConnections < 2 {
-			maxConnections = 2
-			log.Println("Minimum number of connections is 2")
+		infof("Wrote %d messages to %s", res.Written, dest)
+		if sinceMsgID != 0 {
+			if res.Missed > 0 {
+				warnf("%d messages older than message ID %d were synced out of order and not exported", res.Missed, sinceMsgID)
+			}
+			infof("Highest exported message ID: %d", res.MaxMsgID)
 		}
 
-		uids := findNewUIDs(cfg, db)
+	case "get":
+		msgid, err := strconv.ParseInt(fs.Arg(1), 10, 64)
+		if err != nil {
+			fatal(err)
+		}
 
-		var wg sync.WaitGroup
-		for i := 1; i < maxConnections; i++ {
-			wg.Add(1)
-			go fetchAndStore(cfg, i, db, uids, &wg)
+		db, err := openVaultReadOnly(accounts[0])
+		if err != nil {
+			fatal(err)
 		}
 
-		go func() {
-			for {
-				time.Sleep(10 * time.Second)
-				lock(&progress, func() {
-					log.Printf("%d of %d scanned, %d fetched, %d labelupdated", progress.scanned, progress.toScan, progress.fetched, progress.labels)
-				})
-			}
-		}()
+		err = getMessage(db, os.Stdout, msgid, withLabels)
+		if err != nil {
+			fatal(err)
+		}
 
-		wg.Wait()
+	case "search":
+		db, err := openVaultReadOnly(accounts[0])
+		if err != nil {
+			fatal(err)
+		}
 
-	case "mbox":
-		db, err := db.Open(cfg.Get("gmail", "vault"))
+		err = search(db, os.Stdout, filter, query)
 		if err != nil {
-			log.Fatal(err)
+			fatal(err)
+		}
+
+	case "ndjson":
+		db, err := openVaultReadOnly(accounts[0])
+		if err != nil {
+			fatal(err)
+		}
+
+		err = ndjson(db, os.Stdout, filter, parseMsgs)
+		if err != nil {
+			fatal(err)
+		}
+
+	case "maildir":
+		db, err := openVaultReadOnly(accounts[0])
+		if err != nil {
+			fatal(err)
+		}
+
+		err = maildir(db, fs.Arg(1), filter)
+		if err != nil {
+			fatal(err)
+		}
+
+	case "export-by-label":
+		db, err := openVaultReadOnly(accounts[0])
+		if err != nil {
+			fatal(err)
+		}
+
+		err = exportByLabel(db, fs.Arg(1), filter, unlabeled)
+		if err != nil {
+			fatal(err)
+		}
+
+	case "eml-zip":
+		db, err := openVaultReadOnly(accounts[0])
+		if err != nil {
+			fatal(err)
+		}
+
+		err = emlZip(db, fs.Arg(1), filter, emlSubject)
+		if err != nil {
+			fatal(err)
+		}
+
+	case "import-mbox":
+		db, err := openVault(accounts[0])
+		if err != nil {
+			fatal(err)
+		}
+
+		err = importMbox(db, fs.Arg(1), format.Mboxo)
+		if err != nil {
+			fatal(err)
+		}
+		err = db.Close()
+		if err != nil {
+			fatal(err)
+		}
+
+	case "compact":
+		for _, acc := range accounts {
+			db, err := openVault(acc)
+			if err != nil {
+				fatal(err)
+			}
+
+			res, err := db.Compact()
+			if err != nil {
+				fatal(err)
+			}
+			infof("Compacted vault %s with %d messages", acc.get("vault"), db.Size())
+			reportCompaction(res)
+			db.Close()
+		}
+
+	case "dedupe":
+		for _, acc := range accounts {
+			db, err := openVault(acc)
+			if err != nil {
+				fatal(err)
+			}
+
+			n, res, err := db.Dedupe()
+			if err != nil {
+				fatal(err)
+			}
+			infof("Removed %d duplicate messages from vault %s", n, acc.get("vault"))
+			if n > 0 {
+				reportCompaction(res)
+			}
+			db.Close()
+		}
+
+	case "stats":
+		for _, acc := range accounts {
+			db, err := openVaultReadOnly(acc)
+			if err != nil {
+				fatal(err)
+			}
+
+			st, err := db.Stats()
+			if err != nil {
+				fatal(err)
+			}
+			if len(accounts) > 1 && !jsonOutput {
+				fmt.Printf("[%s]\n", acc.name)
+			}
+			err = printStats(st, jsonOutput)
+			if err != nil {
+				fatal(err)
+			}
+			db.Close()
 		}
 
-		mbox(db, os.Stdout)
+	case "verify":
+		failed := false
+		for _, acc := range accounts {
+			vault := acc.get("vault")
+			key, err := acc.encryptionKey()
+			if err != nil {
+				fatal(err)
+			}
+			nrecords, corrupt, err := db.VerifyKey(vault, key)
+			for _, c := range corrupt {
+				if c.MessageID != 0 {
+					warnf("%s: offset %d (message %d): %v", vault, c.Offset, c.MessageID, c.Err)
+				} else {
+					warnf("%s: offset %d: %v", vault, c.Offset, c.Err)
+				}
+			}
+			if err != nil {
+				fatal(err)
+			}
+			infof("%s: verified %d records, %d corrupt", vault, nrecords, len(corrupt))
+			if len(corrupt) > 0 {
+				failed = true
+			}
+		}
+		if failed {
+			os.Exit(1)
+		}
 	}
 }
 
-func findNewUIDs(cfg ini.Config, db *db.DB) chan MsgID {
-	if traceImap {
-		log.Printf("IMAP[0]: Connect")
+// fetch syncs the mailbox of acc to its vault, rescanning all of it if full
+// is set, or fetches the bodies of the messages stored headers only if
+// backfill is set. When ctx is cancelled the messages being fetched are
+// completed and the vault is closed without moving the watermark.
+func fetch(ctx context.Context, acc *account, full, backfill bool) {
+	if acc.section != "gmail" {
+		infof("Syncing account %s", acc.name)
+	}
+	resetProgress()
+
+	infof("Scanning & validating database")
+	var db *db.DB
+	var err error
+	if dryRun {
+		db, err = openDryRunVault(acc)
+	} else {
+		db, err = openVault(acc)
 	}
-
-	email := cfg.Get("gmail", "email")
-	password := cfg.Get("gmail", "password")
-	mailbox := cfg.Get("gmail", "mailbox")
-	client, err := imap.Client(email, password, mailbox)
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
 	}
 
-	if traceImap {
-		log.Printf("IMAP[0]: %d messages in mailbox", client.Mailbox.Messages)
+	infof("Have %d messages", db.Size())
+
+	// Keep the labels seen so far if we have to give up
+	defer atExit(func() {
+		if !dryRun {
+			db.WriteLabels()
+		}
+		db.Close()
+	})()
+
+	maxConnections := positiveInt(acc, "connections", 4)
+	scanConnections := positiveInt(acc, "scan_connections", 1)
+	if maxConnections < scanConnections+1 {
+		maxConnections = scanConnections + 1
+		infof("Minimum number of connections is %d", maxConnections)
+	}
+	// Gmail refuses logins beyond about 15 simultaneous connections
+	if limit := positiveInt(acc, "max_connections", 15); maxConnections > limit {
+		warnf("Limiting connections to %d (max_connections)", limit)
+		maxConnections = limit
+		if scanConnections >= maxConnections {
+			scanConnections = maxConnections - 1
+		}
+		if scanConnections < 1 {
+			fatal("max_connections must be at least 2")
+		}
 	}
-	lock(&progress, func() {
-		progress.toScan = int(client.Mailbox.Messages)
-	})
 
-	step := uint32(100)
-	out := make(chan MsgID, step)
+	limiter, err := syncer.NewLimiter(acc.get("rate_limit"))
+	if err != nil {
+		fatal(err)
+	}
 
-	go func() {
-		begin := uint32(1)
-		for begin < client.Mailbox.Messages {
-			end := begin + step - 1
-			if traceImap {
-				log.Printf("IMAP[0]: UID SEARCH %d:%d", begin, end)
-			}
+	var maxBytes int64
+	if s := acc.get("max_message_bytes"); s != "" {
+		v, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || v < 1 {
+			fatalf("max_message_bytes: %q is not a positive integer", s)
+		}
+		maxBytes = v
+	}
 
-			msgids, err := client.MsgIDSearch(begin, end)
-			if err != nil {
-				log.Fatal(err)
-			}
-			lock(&progress, func() {
-				progress.scanned += len(msgids)
-			})
+	s := &syncer.Syncer{
+		Vault:           db,
+		Connect:         func(mailbox string) (*imap.IMAPClient, error) { return connect(acc, mailbox) },
+		Mailboxes:       mailboxes(acc),
+		Connections:     maxConnections,
+		ScanConnections: scanConnections,
+		QueueSize:       positiveInt(acc, "fetch_queue_size", syncer.DefaultQueueSize),
+		ScanStep:        positiveInt(acc, "scan_step", syncer.DefaultScanStep),
+		MinScanStep:     positiveInt(acc, "scan_step_min", syncer.DefaultMinScanStep),
+		MaxScanStep:     positiveInt(acc, "scan_step_max", syncer.DefaultMaxScanStep),
+		FullScan:        full,
+		Since:           fetchSince.Time,
+		Before:          query.before.Time,
+		ExcludeLabels:   excludeLabels(acc),
+		Backfill:        backfill,
+		Prune:           prune,
+		HeadersOnly:     headersOnly,
+		MaxMessageBytes: maxBytes,
+		NewestFirst:     newestFirst,
+		DryRun:          dryRun,
+		Strict:          strict,
+		Limiter:         limiter,
+		Log:             logger{},
+		OnProgress:      setProgress,
+	}
+	err = s.Fetch(ctx)
+	finishProgress()
+
+	p := s.Progress()
+	switch {
+	case err != nil && ctx.Err() != nil:
+		warnf("Sync interrupted; %d of %d new messages found not fetched", p.Queued-p.Fetched, p.Queued)
+	case err != nil:
+		fatal(err)
+	case dryRun:
+		fmt.Printf("%d messages to fetch, %d label updates\n", p.Queued, p.Labels)
+		if p.Pruned > 0 {
+			fmt.Printf("%d messages to prune\n", p.Pruned)
+		}
+	}
+	if backfill && !dryRun {
+		if n := len(db.HeaderOnly()); n > 0 {
+			infof("%d messages are still stored headers only", n)
+		} else {
+			infof("All messages have been backfilled")
+		}
+	}
+	db.Close()
+}
 
-			begin += step
+// idleInterval is how long the daemon idles before reissuing IDLE, within
+// the 30 minutes after which servers may drop the connection.
+const idleInterval = 29 * time.Minute
+
+// daemon syncs acc, then waits for new messages with IDLE and syncs again
+// when there are any, until ctx is cancelled. Label changes on existing
+// messages aren't announced by the server, so every reconcile_interval the
+// sync is a full scan.
+func daemon(ctx context.Context, acc *account) {
+	interval := 24 * time.Hour
+	if s := acc.get("reconcile_interval"); s != "" {
+		v, err := time.ParseDuration(s)
+		if err != nil || v <= 0 {
+			fatal("reconcile_interval: " + strconv.Quote(s) + " is not a positive duration")
+		}
+		interval = v
+	}
 
-			fetch := 0
-			for _, msgid := range msgids {
-				if !db.HaveUID(msgid.MsgID) {
-					out <- MsgID{msgid.UID, msgid.MsgID}
-					fetch++
-				}
+	var idler *imap.IMAPClient
+	lastFull := time.Now()
+	full := fullScan
+	for ctx.Err() == nil {
+		fetch(ctx, acc, full, false)
+		if full {
+			lastFull = time.Now()
+		}
 
-				if !sliceEquals(msgid.Labels, db.Labels(msgid.MsgID)) {
-					db.SetLabels(msgid.MsgID, msgid.Labels)
-					lock(&progress, func() {
-						progress.labels++
-					})
+		for ctx.Err() == nil {
+			if idler == nil {
+				var err error
+				// Only the first mailbox is watched; changes in the
+				// others are picked up by the syncs it triggers
+				idler, err = connect(acc, mailboxes(acc)[0])
+				if err != nil {
+					warnf("%v; reconnecting in a minute", err)
+					sleep(ctx, time.Minute)
+					continue
+				}
+				if !idler.Caps["IDLE"] {
+					fatal("Server does not support IDLE")
 				}
 			}
 
-			err = db.WriteLabels()
-			if err != nil {
-				log.Fatal(err)
+			changed, err := idler.Idle(ctx, idleInterval)
+			if err != nil && ctx.Err() == nil {
+				warnf("IDLE: %v; reconnecting in a minute", err)
+				idler.Logout(time.Second)
+				idler = nil
+				sleep(ctx, time.Minute)
+				continue
 			}
-
-			if fetch == 0 && step < 3200 {
-				// Scale up for faster scanning of known messages
-				step *= 2
-			} else if fetch > 0 && step > 100 {
-				// Scale down to avoid timeouts and write reasonable label
-				// chunks when we need to fetch lots of messages.
-				step /= 2
+			full = time.Since(lastFull) >= interval
+			if changed || full {
+				break
 			}
 		}
-		close(out)
-	}()
+	}
+}
 
-	return out
+// sleep waits for d or until ctx is cancelled.
+func sleep(ctx context.Context, d time.Duration) {
+	select {
+	case <-time.After(d):
+	case <-ctx.Done():
+	}
 }
 
-func sliceEquals(a, b []string) bool {
-	if len(a) != len(b) {
-		return false
+// positiveInt returns the value of the integer option key, or def if it's not
+// set. Anything but a positive integer is a fatal error.
+func positiveInt(acc *account, key string, def int) int {
+	s := acc.get(key)
+	if s == "" {
+		return def
 	}
-	for i := range a {
-		if a[i] != b[i] {
-			return false
+	v, err := strconv.Atoi(s)
+	if err != nil || v < 1 {
+		fatalf("%s: %q is not a positive integer", key, s)
+	}
+	return v
+}
+
+// mailboxes returns the comma separated mailboxes of acc, or the default
+// mailbox as the empty name if none are given.
+func mailboxes(acc *account) []string {
+	var res []string
+	for _, mb := range strings.Split(acc.get("mailbox"), ",") {
+		if mb = strings.TrimSpace(mb); mb != "" {
+			res = append(res, mb)
 		}
 	}
-	return true
+	if len(res) == 0 {
+		return []string{""}
+	}
+	return res
 }
 
-func fetchAndStore(cfg ini.Config, id int, db *db.DB, msgids chan MsgID, wg *sync.WaitGroup) {
-	if traceImap {
-		log.Printf("IMAP[%d]: Connect", id)
+// openVault opens the vault of acc, configured for writing according to the
+// account settings.
+func openVault(acc *account) (*db.DB, error) {
+	opts, err := vaultOptions(acc)
+	if err != nil {
+		return nil, err
+	}
+	vault, err := db.OpenWithOptions(acc.get("vault"), opts)
+	if err != nil {
+		return nil, err
 	}
 
-	email := cfg.Get("gmail", "email")
-	password := cfg.Get("gmail", "password")
-	mailbox := cfg.Get("gmail", "mailbox")
-	client, err := imap.Client(email, password, mailbox)
+	if h := acc.get("hash"); h != "" {
+		err = vault.SetHash(h)
+		if err != nil {
+			vault.Close()
+			return nil, err
+		}
+	}
+	if c := acc.get("compression"); c != "" {
+		err = vault.SetCompression(c)
+		if err != nil {
+			vault.Close()
+			return nil, err
+		}
+	}
+	if r := acc.get("min_compress_ratio"); r != "" {
+		ratio, err := strconv.ParseFloat(r, 64)
+		if err == nil {
+			err = vault.SetMinCompressRatio(ratio)
+		}
+		if err != nil {
+			vault.Close()
+			return nil, errors.New("min_compress_ratio: " + strconv.Quote(r) + " is not a number of at least 1")
+		}
+	}
+	return vault, nil
+}
+
+// openVaultReadOnly opens the vault of acc for a command that only reads it,
+// which can run while a fetch appends to the vault.
+func openVaultReadOnly(acc *account) (*db.DB, error) {
+	opts, err := vaultOptions(acc)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
+	opts.ReadOnly = true
+	return db.OpenWithOptions(acc.get("vault"), opts)
+}
 
-	if traceImap {
-		log.Printf("IMAP[%d]: Ready", id)
+// vaultOptions returns the options for opening the vault of acc, with its
+// encryption key and the bloom_fp_rate key checked before it's opened.
+func vaultOptions(acc *account) (db.Options, error) {
+	var opts db.Options
+	key, err := acc.encryptionKey()
+	if err != nil {
+		return opts, err
+	}
+	opts.Passphrase = key
+	if r := acc.get("bloom_fp_rate"); r != "" {
+		rate, err := strconv.ParseFloat(r, 64)
+		if err != nil || !(rate > 0 && rate < 1) {
+			return opts, errors.New("bloom_fp_rate: " + strconv.Quote(r) + " is not a number between 0 and 1")
+		}
+		opts.BloomFPRate = rate
 	}
+	return opts, nil
+}
 
-	for {
-		select {
-		case msgid, ok := <-msgids:
-			if !ok {
-				break
-			}
-			if traceImap {
-				log.Printf("IMAP[%d]: UID FETCH %d", id, msgid.MsgID)
-			}
+// openDryRunVault opens the vault of acc read-only for fetch -dry-run, or if
+// there is none yet an empty one in memory, as a first fetch would create.
+func openDryRunVault(acc *account) (*db.DB, error) {
+	vault, err := openVaultReadOnly(acc)
+	if os.IsNotExist(err) {
+		return db.OpenStorageReadOnly(&db.MemoryStorage{}, "")
+	}
+	return vault, err
+}
 
-			body, err := client.GetMail(msgid.UID)
-			if err != nil {
-				log.Fatal(err)
-			}
+// reportCompaction logs the space reclaimed by a compaction.
+func reportCompaction(res db.CompactResult) {
+	reclaimed := res.SizeBefore - res.SizeAfter
+	if reclaimed < 0 {
+		// Nothing superseded, and a new checkpoint or index written
+		reclaimed = 0
+	}
+	infof("Size %s before, %s after (%s reclaimed)", formatBytes(float64(res.SizeBefore)), formatBytes(float64(res.SizeAfter)), formatBytes(float64(reclaimed)))
+	infof("Dropped %d of %d records, coalescing %d labels records into one", res.Dropped, res.Records, res.Labels)
+}
 
-			err = db.WriteMessage(msgid.MsgID, body)
-			if err != nil {
-				log.Fatal(err)
-			}
+// excludeLabels returns the labels of the exclude_labels key of acc.
+func excludeLabels(acc *account) []string {
+	var labels []string
+	for _, l := range strings.Split(acc.get("exclude_labels"), ",") {
+		if l = strings.TrimSpace(l); l != "" {
+			labels = append(labels, l)
+		}
+	}
+	return labels
+}
 
-			lock(&progress, func() {
-				progress.fetched++
-			})
+// labelMapping returns the label renames for exports from acc, given by
+// label_map and strip_label_backslash and then the -map-label flags.
+func labelMapping(acc *account) (labelMap, error) {
+	var m labelMap
+	if s := acc.get("strip_label_backslash"); s != "" {
+		v, err := strconv.ParseBool(s)
+		if err != nil {
+			return m, errors.New("strip_label_backslash: " + err.Error())
 		}
+		m.strip = v
 	}
+	for _, pair := range strings.Split(acc.get("label_map"), ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		err := m.add(pair)
+		if err != nil {
+			return m, errors.New("label_map: " + err.Error())
+		}
+	}
+	for _, pair := range mapLabels {
+		err := m.add(pair)
+		if err != nil {
+			return m, errors.New("-map-label: " + err.Error())
+		}
+	}
+	return m, nil
+}
 
-	wg.Done()
+// tokenSource returns the OAuth2 access token source configured for acc, or
+// nil if password authentication should be used.
+func tokenSource(acc *account) imap.TokenSource {
+	if rt := acc.get("refresh_token"); rt != "" {
+		return &oauth.RefreshSource{
+			ClientID:     acc.get("client_id"),
+			ClientSecret: acc.get("client_secret"),
+			RefreshToken: rt,
+		}
+	}
+	if t := acc.get("oauth_token"); t != "" {
+		return imap.StaticToken(t)
+	}
+	return nil
 }
 
-func mbox(db *db.DB, wr io.Writer) {
-	var nwritten int
-	nl := []byte("\n")
-	from := []byte("From ")
-	esc := []byte(">")
+func server(acc *account) string {
+	host, port := acc.get("server"), acc.get("port")
+	if host == "" && port == "" && !startTLS(acc) {
+		return imap.DefaultServer
+	}
+	if host == "" {
+		host = "imap.gmail.com"
+	}
+	if port == "" {
+		port = "993"
+		if startTLS(acc) {
+			port = "143"
+		}
+	}
+	return net.JoinHostPort(host, port)
+}
 
-	bwr := bufio.NewWriter(wr)
+// startTLS returns whether acc connects in plain text upgraded with STARTTLS
+// rather than with TLS from the start.
+func startTLS(acc *account) bool {
+	return acc.get("tls") == "starttls"
+}
 
-	for {
-		rec, err := db.ReadMessage()
-		if err == io.EOF {
-			break
+// tlsConfig returns the TLS configuration for connecting to the server of
+// acc. Certificates are verified against the system roots, or the roots in
+// ca_file, unless insecure_skip_verify is set.
+func tlsConfig(acc *account) (*tls.Config, error) {
+	var cfg tls.Config
+	if s := acc.get("insecure_skip_verify"); s != "" {
+		v, err := strconv.ParseBool(s)
+		if err != nil {
+			return nil, errors.New("insecure_skip_verify: " + err.Error())
+		}
+		cfg.InsecureSkipVerify = v
+	}
+	if f := acc.get("ca_file"); f != "" {
+		bs, err := ioutil.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(bs) {
+			return nil, errors.New("No certificates found in " + f)
 		}
+	}
+	return &cfg, nil
+}
 
-		bwr.Write([]byte("From MAILER-DAEMON Thu Jan  1 01:00:00 1970\n"))
-		if labels := db.Labels(rec.MessageID); len(labels) > 0 {
-			bwr.Write([]byte("X-Gmail-Labels: " + strings.Join(labels, ", ") + "\n"))
+func connect(acc *account, mailbox string) (*imap.IMAPClient, error) {
+	email := acc.get("email")
+
+	tlsCfg, err := tlsConfig(acc)
+	if err != nil {
+		return nil, err
+	}
+	timeout, err := imapTimeout(acc)
+	if err != nil {
+		return nil, err
+	}
+	retries := 3
+	if s := acc.get("retries"); s != "" {
+		retries, err = strconv.Atoi(s)
+		if err != nil || retries < 0 {
+			return nil, fmt.Errorf("retries: %q is not a non-negative integer", s)
 		}
-		bwr.Write([]byte("X-Gmail-MsgID: " + strconv.FormatInt(rec.MessageID, 10) + "\n"))
-		s := bufio.NewScanner(bytes.NewBuffer(rec.Data))
-		for s.Scan() {
-			line := s.Bytes()
-			if bytes.HasPrefix(line, from) {
-				bwr.Write(esc)
-			}
-			bwr.Write(line)
-			bwr.Write(nl)
+	}
+	var compress bool
+	if s := acc.get("imap_compression"); s != "" {
+		compress, err = strconv.ParseBool(s)
+		if err != nil {
+			return nil, errors.New("imap_compression: " + err.Error())
+		}
+	}
+
+	var client *imap.IMAPClient
+	if acc.tokens != nil {
+		client, err = imap.ClientOAuth(server(acc), tlsCfg, startTLS(acc), compress, timeout, email, acc.tokens, mailbox)
+	} else {
+		var password string
+		password, err = acc.password()
+		if err != nil {
+			return nil, err
 		}
-		bwr.Write(nl)
-		bwr.Flush()
+		client, err = imap.Client(server(acc), tlsCfg, startTLS(acc), compress, timeout, email, password, mailbox)
+	}
+	if err != nil {
+		return nil, err
+	}
 
-		nwritten++
+	client.Retries = retries
+	return client, nil
+}
+
+// imapTimeout returns the timeout for IMAP commands of acc, or zero for the
+// default.
+func imapTimeout(acc *account) (time.Duration, error) {
+	s := acc.get("timeout")
+	if s == "" {
+		return 0, nil
+	}
+	// Seconds, or a duration such as "2m"
+	timeout, err := time.ParseDuration(s)
+	if v, aerr := strconv.Atoi(s); aerr == nil {
+		timeout, err = time.Duration(v)*time.Second, nil
+	}
+	if err != nil || timeout <= 0 {
+		return 0, errors.New("timeout: " + strconv.Quote(s) + " is not a positive duration")
 	}
+	return timeout, nil
+}
+
+// getMessage writes the message with the given ID to wr as stored,
+// optionally preceded by X-Gmail-Labels and X-Gmail-MsgID headers. The
+// message is streamed, so its hash is only checked once it has been written
+// and a corrupt message is reported after the fact.
+func getMessage(vault *db.DB, wr io.Writer, msgid int64, withLabels bool) error {
+	rd, err := vault.MessageReader(msgid)
+	if err == db.ErrNoMessage {
+		return fmt.Errorf("No message %d in vault", msgid)
+	}
+	if err != nil {
+		return err
+	}
+	defer rd.Close()
 
-	log.Printf("Wrote %d messages to stdout", nwritten)
+	if withLabels {
+		if labels := mapping.apply(vault.Labels(msgid)); len(labels) > 0 {
+			fmt.Fprintf(wr, "X-Gmail-Labels: %s\r\n", strings.Join(labels, ", "))
+		}
+		fmt.Fprintf(wr, "X-Gmail-MsgID: %d\r\n", msgid)
+	}
+	_, err = io.Copy(wr, rd)
+	if _, ok := err.(*db.RecordError); ok {
+		return fmt.Errorf("Message %d was written, but is corrupt: %v", msgid, err)
+	}
+	return err
 }
 
 type Locker interface {
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/calmh/gmailsync/syncer"
+)
+
+// totals is the sum of the progress of the syncs before the current one,
+// guarded by the progress lock.
+var totals struct {
+	scanned, fetched, labels, pruned, failed int
+	bytes                                    int64
+}
+
+// addTotals adds the progress of a finished sync to the totals. The caller
+// holds the progress lock.
+func addTotals(p syncer.Progress) {
+	totals.scanned += p.Scanned
+	totals.fetched += p.Fetched
+	totals.bytes += p.Bytes
+	totals.labels += p.Labels
+	totals.pruned += p.Pruned
+	totals.failed += len(p.Failed)
+}
+
+// serveMetrics serves the sync counters in the Prometheus text format at
+// /metrics on addr.
+func serveMetrics(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", writeMetrics)
+	go http.Serve(l, mux)
+	return nil
+}
+
+func writeMetrics(w http.ResponseWriter, r *http.Request) {
+	type metric struct {
+		name  string
+		kind  string
+		help  string
+		value int64
+	}
+	var metrics []metric
+	lock(&progress, func() {
+		p := progress.Progress
+		metrics = []metric{
+			{"gmailsync_messages_scanned_total", "counter", "Messages scanned in the mailbox", int64(totals.scanned + p.Scanned)},
+			{"gmailsync_messages_fetched_total", "counter", "Messages fetched and stored in the vault", int64(totals.fetched + p.Fetched)},
+			{"gmailsync_fetched_bytes_total", "counter", "Size of the messages fetched", totals.bytes + p.Bytes},
+			{"gmailsync_label_updates_total", "counter", "Messages with changed labels or flags", int64(totals.labels + p.Labels)},
+			{"gmailsync_pruned_total", "counter", "Messages removed from the vault by -prune", int64(totals.pruned + p.Pruned)},
+			{"gmailsync_fetch_errors_total", "counter", "Messages that failed to fetch", int64(totals.failed + len(p.Failed))},
+			{"gmailsync_connections", "gauge", "IMAP connections in use", int64(p.Connections)},
+		}
+	})
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, m := range metrics {
+		fmt.Fprintf(w, "# HELP %s %s.\n# TYPE %s %s\n%s %d\n", m.name, m.help, m.name, m.kind, m.name, m.value)
+	}
+}
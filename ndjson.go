@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/mail"
+
+	"github.com/calmh/gmailsync/db"
+)
+
+type jsonMessage struct {
+	MsgID    int64    `json:"msgid"`
+	ThreadID int64    `json:"thread_id,omitempty"`
+	Labels   []string `json:"labels"`
+	Flags    []string `json:"flags,omitempty"`
+	From     string   `json:"from,omitempty"`
+	To       string   `json:"to,omitempty"`
+	Subject  string   `json:"subject,omitempty"`
+	Date     string   `json:"date,omitempty"`
+	Raw      []byte   `json:"raw"`
+}
+
+// ndjson writes one JSON object per message to wr, with the raw message
+// base64 encoded. If parse is set the main headers are included as well.
+func ndjson(vault *db.DB, wr io.Writer, filter labelFilter, parse bool) error {
+	var nwritten int
+	emitted := make(map[int64]bool)
+
+	bwr := bufio.NewWriter(wr)
+	enc := json.NewEncoder(bwr)
+
+	for {
+		rec, err := vault.ReadMessage()
+		if err == io.EOF {
+			break
+		}
+		if _, ok := err.(*db.RecordError); ok {
+			warnf("Skipping %v", err)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		if emitted[rec.MessageID] {
+			// A duplicate copy in the vault
+			continue
+		}
+		emitted[rec.MessageID] = true
+
+		labels := vault.Labels(rec.MessageID)
+		if !filter.match(labels) {
+			continue
+		}
+		labels = mapping.apply(labels)
+		if labels == nil {
+			labels = []string{}
+		}
+
+		msg := jsonMessage{MsgID: rec.MessageID, ThreadID: rec.ThreadID, Labels: labels, Flags: vault.Flags(rec.MessageID), Raw: rec.Data}
+		if parse {
+			parseHeaders(&msg, rec.Data)
+		}
+
+		err = enc.Encode(msg)
+		if err != nil {
+			return err
+		}
+		nwritten++
+	}
+
+	err := bwr.Flush()
+	if err != nil {
+		return err
+	}
+
+	infof("Wrote %d messages to stdout", nwritten)
+	return nil
+}
+
+func parseHeaders(msg *jsonMessage, data []byte) {
+	m, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return
+	}
+
+	msg.From = decodeHeader(m.Header.Get("From"))
+	msg.To = decodeHeader(m.Header.Get("To"))
+	msg.Subject = decodeHeader(m.Header.Get("Subject"))
+	msg.Date = m.Header.Get("Date")
+	if t, err := m.Header.Date(); err == nil {
+		msg.Date = t.UTC().Format("2006-01-02T15:04:05Z")
+	}
+}
+
+// decodeHeader decodes any RFC 2047 encoded words in the header value s.
+func decodeHeader(s string) string {
+	var dec mime.WordDecoder
+	if d, err := dec.DecodeHeader(s); err == nil {
+		return d
+	}
+	return s
+}
@@ -0,0 +1,67 @@
+package oauth
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const tokenURL = "https://accounts.google.com/o/oauth2/token"
+
+// RefreshSource hands out access tokens, using the refresh token to get a
+// new one from Google whenever the current one is about to expire.
+type RefreshSource struct {
+	ClientID     string
+	ClientSecret string
+	RefreshToken string
+
+	mut     sync.Mutex
+	token   string
+	expires time.Time
+}
+
+type tokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	ExpiresIn        int    `json:"expires_in"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+func (s *RefreshSource) Token() (string, error) {
+	defer s.mut.Unlock()
+	s.mut.Lock()
+
+	if s.token != "" && time.Now().Add(time.Minute).Before(s.expires) {
+		return s.token, nil
+	}
+
+	resp, err := http.PostForm(tokenURL, url.Values{
+		"client_id":     {s.ClientID},
+		"client_secret": {s.ClientSecret},
+		"refresh_token": {s.RefreshToken},
+		"grant_type":    {"refresh_token"},
+	})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var tr tokenResponse
+	err = json.NewDecoder(resp.Body).Decode(&tr)
+	if err != nil {
+		return "", err
+	}
+	if tr.Error != "" {
+		return "", errors.New("oauth: " + tr.Error + ": " + tr.ErrorDescription)
+	}
+	if tr.AccessToken == "" {
+		return "", errors.New("oauth: no access token in response")
+	}
+
+	s.token = tr.AccessToken
+	s.expires = time.Now().Add(time.Duration(tr.ExpiresIn) * time.Second)
+	return s.token, nil
+}
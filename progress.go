@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/calmh/gmailsync/syncer"
+)
+
+// progress is the latest progress reported by the syncer, through its
+// OnProgress callback. showProgress reports it periodically.
+var progress struct {
+	sync.Mutex
+	syncer.Progress
+}
+
+// progressTTY is true when progress is shown as an updating line on the
+// terminal, rather than logged periodically.
+var progressTTY bool
+
+// resetProgress starts the progress of a new sync, adding that of the
+// previous one to the totals.
+func resetProgress() {
+	lock(&progress, func() {
+		addTotals(progress.Progress)
+		progress.Progress = syncer.Progress{Started: time.Now()}
+	})
+}
+
+func setProgress(p syncer.Progress) {
+	lock(&progress, func() {
+		progress.Progress = p
+	})
+}
+
+// showProgress reports the progress of fetch until the program exits.
+func showProgress() {
+	if quiet {
+		return
+	}
+
+	interval := 10 * time.Second
+	if fi, err := os.Stdout.Stat(); err == nil && fi.Mode()&os.ModeCharDevice != 0 {
+		progressTTY = true
+		interval = time.Second
+	}
+	if reportEvery > 0 {
+		interval = reportEvery
+	}
+
+	var prevFetched int
+	var prevBytes int64
+	for {
+		time.Sleep(interval)
+		lock(&progress, func() {
+			if !progressTTY {
+				byteRate := float64(progress.Bytes) / time.Since(progress.Started).Seconds()
+				infof("%d of %d scanned, %d fetched (%s, %s/s), %d labelupdated", progress.Scanned, progress.ToScan, progress.Fetched,
+					formatBytes(float64(progress.Bytes)), formatBytes(byteRate), progress.Labels)
+				return
+			}
+
+			if progress.Fetched < prevFetched {
+				// Started on the next account
+				prevFetched, prevBytes = 0, 0
+			}
+			rate := float64(progress.Fetched-prevFetched) / interval.Seconds()
+			byteRate := float64(progress.Bytes-prevBytes) / interval.Seconds()
+			prevFetched, prevBytes = progress.Fetched, progress.Bytes
+			fmt.Printf("\r%s\x1b[K", progressLine(rate, byteRate))
+		})
+	}
+}
+
+// finishProgress ends the progress line, so that following output starts on
+// a line of its own.
+func finishProgress() {
+	lock(&progress, func() {
+		if progressTTY {
+			fmt.Printf("\r%s\x1b[K\n", progressLine(0, 0))
+		}
+	})
+}
+
+// progressLine formats the progress as the percentage of the scan, or once
+// the scan is done the percentage of the messages fetched, with an estimate
+// of the remaining time. The caller holds the progress lock.
+func progressLine(rate, byteRate float64) string {
+	phase, done, total := "Scanning", progress.Scanned, progress.ToScan
+	if progress.ScanDone {
+		phase, done, total = "Fetching", progress.Fetched, progress.Queued
+	}
+	if done > total {
+		done = total
+	}
+
+	pct := 100.0
+	if total > 0 {
+		pct = 100 * float64(done) / float64(total)
+	}
+
+	eta := "-"
+	if elapsed := time.Since(progress.Started); done > 0 && done < total {
+		remaining := time.Duration(float64(elapsed) * float64(total-done) / float64(done))
+		eta = (remaining / time.Second * time.Second).String()
+	}
+
+	return fmt.Sprintf("%s %5.1f%% (%d of %d), %d fetched (%s) at %.1f msg/s (%s/s), %d label updates, ETA %s",
+		phase, pct, done, total, progress.Fetched, formatBytes(float64(progress.Bytes)), rate, formatBytes(byteRate), progress.Labels, eta)
+}
+
+// formatBytes formats a byte count with a binary unit prefix.
+func formatBytes(n float64) string {
+	units := []string{"B", "KiB", "MiB", "GiB"}
+	i := 0
+	for n >= 1024 && i < len(units)-1 {
+		n /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%.0f %s", n, units[i])
+	}
+	return fmt.Sprintf("%.1f %s", n, units[i])
+}
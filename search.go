@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/calmh/gmailsync/db"
+)
+
+// searchQuery selects messages by header contents and date. Empty fields
+// match any message.
+type searchQuery struct {
+	from    string
+	to      string
+	subject string
+	body    string
+	before  dateValue
+	after   dateValue
+}
+
+// dateValue is a flag.Value holding a date given as YYYY-MM-DD.
+type dateValue struct {
+	time.Time
+}
+
+func (d *dateValue) String() string {
+	if d.IsZero() {
+		return ""
+	}
+	return d.Format("2006-01-02")
+}
+
+func (d *dateValue) Set(s string) error {
+	t, err := time.Parse("2006-01-02", s)
+	if err != nil {
+		return errors.New("date must be given as YYYY-MM-DD")
+	}
+	d.Time = t
+	return nil
+}
+
+// msgIDList is a flag.Value collecting message IDs from repeated flags, each
+// holding one or more comma separated IDs.
+type msgIDList map[int64]bool
+
+func (l msgIDList) String() string {
+	var ids []string
+	for id := range l {
+		ids = append(ids, strconv.FormatInt(id, 10))
+	}
+	return strings.Join(ids, ",")
+}
+
+func (l msgIDList) Set(s string) error {
+	for _, f := range strings.Split(s, ",") {
+		id, err := strconv.ParseInt(strings.TrimSpace(f), 10, 64)
+		if err != nil {
+			return err
+		}
+		l[id] = true
+	}
+	return nil
+}
+
+// search writes the message ID, date, sender and subject of each message
+// matching filter and q to wr, one message per line and tab separated.
+func search(vault *db.DB, wr io.Writer, filter labelFilter, q searchQuery) error {
+	var nfound int
+
+	bwr := bufio.NewWriter(wr)
+
+	for {
+		rec, err := vault.ReadMessage()
+		if err == io.EOF {
+			break
+		}
+		if _, ok := err.(*db.RecordError); ok {
+			warnf("Skipping %v", err)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		if !filter.match(vault.Labels(rec.MessageID)) {
+			continue
+		}
+
+		m, err := mail.ReadMessage(bytes.NewReader(rec.Data))
+		if err != nil {
+			continue
+		}
+		from := decodeHeader(m.Header.Get("From"))
+		subject := decodeHeader(m.Header.Get("Subject"))
+		if !q.match(m, from, subject) {
+			continue
+		}
+
+		date := "-"
+		if t, err := m.Header.Date(); err == nil {
+			date = t.UTC().Format("2006-01-02")
+		}
+		fmt.Fprintf(bwr, "%d\t%s\t%s\t%s\n", rec.MessageID, date, from, subject)
+		nfound++
+	}
+
+	err := bwr.Flush()
+	if err != nil {
+		return err
+	}
+
+	infof("Found %d messages", nfound)
+	return nil
+}
+
+func (q searchQuery) match(m *mail.Message, from, subject string) bool {
+	if !containsFold(from, q.from) || !containsFold(subject, q.subject) {
+		return false
+	}
+	if !containsFold(decodeHeader(m.Header.Get("To")+", "+m.Header.Get("Cc")), q.to) {
+		return false
+	}
+
+	if !q.before.IsZero() || !q.after.IsZero() {
+		t, err := m.Header.Date()
+		if err != nil {
+			return false
+		}
+		if !q.before.IsZero() && !t.Before(q.before.Time) {
+			return false
+		}
+		if !q.after.IsZero() && t.Before(q.after.Time.AddDate(0, 0, 1)) {
+			return false
+		}
+	}
+
+	if q.body != "" {
+		// The body is matched as stored, without decoding any transfer
+		// encoding.
+		body, err := ioutil.ReadAll(m.Body)
+		if err != nil || !containsFold(string(body), q.body) {
+			return false
+		}
+	}
+	return true
+}
+
+func containsFold(s, substr string) bool {
+	return strings.Contains(strings.ToLower(s), strings.ToLower(substr))
+}
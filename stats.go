@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/calmh/gmailsync/db"
+)
+
+type jsonStats struct {
+	Messages    int            `json:"messages"`
+	Labels      map[string]int `json:"labels"`
+	FileSize    int64          `json:"fileSize"`
+	StoredBytes int64          `json:"storedBytes"`
+	RawBytes    int64          `json:"rawBytes"`
+	Created     time.Time      `json:"created"`
+	Updated     *time.Time     `json:"updated,omitempty"`
+	UIDValidity uint32         `json:"uidValidity"`
+	LastUID     uint32         `json:"lastUID"`
+}
+
+func printStats(st db.Stats, asJSON bool) error {
+	if asJSON {
+		js := jsonStats{
+			Messages:    st.Messages,
+			Labels:      st.Labels,
+			FileSize:    st.FileSize,
+			StoredBytes: st.StoredBytes,
+			RawBytes:    st.RawBytes,
+			Created:     st.Created,
+			UIDValidity: st.UIDValidity,
+			LastUID:     st.LastUID,
+		}
+		if !st.Updated.IsZero() {
+			js.Updated = &st.Updated
+		}
+		enc := json.NewEncoder(os.Stdout)
+		return enc.Encode(js)
+	}
+
+	fmt.Printf("Messages:     %d\n", st.Messages)
+	fmt.Printf("File size:    %d bytes\n", st.FileSize)
+	fmt.Printf("Message data: %d bytes stored, ~%d bytes uncompressed", st.StoredBytes, st.RawBytes)
+	if st.RawBytes > 0 {
+		fmt.Printf(" (%.0f%%)", 100*float64(st.StoredBytes)/float64(st.RawBytes))
+	}
+	fmt.Println()
+	fmt.Printf("Created:      %s\n", st.Created.Format(time.RFC1123))
+	if st.Updated.IsZero() {
+		fmt.Printf("Updated:      never\n")
+	} else {
+		fmt.Printf("Updated:      %s\n", st.Updated.Format(time.RFC1123))
+	}
+	fmt.Printf("Watermark:    UID %d (UIDVALIDITY %d)\n", st.LastUID, st.UIDValidity)
+	fmt.Printf("Labels:       %d\n", len(st.Labels))
+
+	var labels []string
+	for label := range st.Labels {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	for _, label := range labels {
+		fmt.Printf("  %8d  %s\n", st.Labels[label], label)
+	}
+	return nil
+}
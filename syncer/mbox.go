@@ -0,0 +1,369 @@
+package syncer
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/calmh/gmailsync/db"
+)
+
+// ExportOptions selects the messages written by Export and their format.
+type ExportOptions struct {
+	// Filter, if not nil, selects messages by their labels
+	Filter func(labels []string) bool
+	// MapLabels, if not nil, renames the labels of the messages written
+	MapLabels func(labels []string) []string
+	// SinceMsgID, if nonzero, selects messages with a higher message ID
+	SinceMsgID int64
+	// MsgIDs, if not empty, selects the messages with these message IDs
+	MsgIDs map[int64]bool
+	Format MboxFormat
+}
+
+// ExportResult summarizes an Export.
+type ExportResult struct {
+	Written int
+	// Missed is the number of messages with message IDs below SinceMsgID
+	// that were synced out of order, and so probably never exported
+	Missed int
+	// MaxMsgID is the highest message ID written, or SinceMsgID if none
+	MaxMsgID int64
+}
+
+// MboxFormat selects variations of the mbox format.
+type MboxFormat struct {
+	// CRLF selects CRLF line endings instead of LF
+	CRLF bool
+	// ContentLength adds a Content-Length header with the length of the
+	// body as written, replacing any in the original message
+	ContentLength bool
+	// Mboxo quotes only lines starting with "From ", instead of also the
+	// already quoted ones as with the default mboxrd quoting. Readers can't
+	// tell a quoted line from one starting with ">From " in mboxo.
+	Mboxo bool
+	// Raw writes the messages as stored, after the "From " line, quoting
+	// only the lines that need it. Line endings are left as they are and
+	// no headers are added, so the labels, message ID and flags are not
+	// exported. CRLF and ContentLength don't apply.
+	Raw bool
+}
+
+// Export writes the messages in the vault selected by opts to wr in MBOX
+// format. The labels and flags of each message are looked up as it is
+// written, which relies on Open having read those of all messages.
+//
+// Incremental exports with SinceMsgID rely on Gmail message IDs increasing
+// with the time messages arrive, and on messages being synced in roughly
+// the same order. A message with a lower ID synced after the previous
+// export, such as when an initial sync was interrupted, would be missed;
+// such records are detected by their position in the vault and reported.
+func (s *Syncer) Export(wr io.Writer, opts ExportOptions) (ExportResult, error) {
+	if s.Log == nil {
+		s.Log = nopLogger{}
+	}
+
+	var res ExportResult
+	var seenNew bool
+	emitted := make(map[int64]bool)
+
+	bwr := bufio.NewWriter(wr)
+
+	for {
+		rec, err := s.Vault.ReadMessage()
+		if err == io.EOF {
+			break
+		}
+		if _, ok := err.(*db.RecordError); ok {
+			s.Log.Warnf("Skipping %v", err)
+			continue
+		}
+		if err != nil {
+			return res, err
+		}
+
+		if opts.SinceMsgID != 0 {
+			if rec.MessageID <= opts.SinceMsgID {
+				if seenNew {
+					// Appended after a message newer than the
+					// previous export, so probably not exported.
+					res.Missed++
+				}
+				continue
+			}
+			seenNew = true
+		}
+
+		if len(opts.MsgIDs) > 0 && !opts.MsgIDs[rec.MessageID] {
+			continue
+		}
+
+		if emitted[rec.MessageID] {
+			// A duplicate copy in the vault
+			continue
+		}
+		emitted[rec.MessageID] = true
+
+		labels := s.Vault.Labels(rec.MessageID)
+		if opts.Filter != nil && !opts.Filter(labels) {
+			continue
+		}
+
+		if opts.MapLabels != nil {
+			labels = opts.MapLabels(labels)
+		}
+		// Flushing after each message catches write errors early. It
+		// doesn't flush a compressing writer such as gzip.Writer, which
+		// keeps buffering on its own.
+		WriteMboxMessage(bwr, rec, labels, s.Vault.Flags(rec.MessageID), opts.Format)
+		err = bwr.Flush()
+		if err != nil {
+			return res, err
+		}
+
+		if rec.MessageID > res.MaxMsgID {
+			res.MaxMsgID = rec.MessageID
+		}
+		res.Written++
+	}
+
+	if res.MaxMsgID == 0 {
+		res.MaxMsgID = opts.SinceMsgID
+	}
+	return res, nil
+}
+
+var (
+	from = []byte("From ")
+	esc  = []byte(">")
+)
+
+// WriteMboxMessage writes rec to bwr as an mbox message, with its labels,
+// message ID and thread ID as X-Gmail-Labels, X-Gmail-MsgID and
+// X-GM-Thread-Id headers, and its flags as Status and X-Status headers.
+// A message without labels, flags or thread ID gets no such header.
+func WriteMboxMessage(bwr *bufio.Writer, rec *db.MessageRecord, labels, flags []string, format MboxFormat) {
+	if format.Raw {
+		writeRawMboxMessage(bwr, rec, format.Mboxo)
+		return
+	}
+
+	eol := "\n"
+	if format.CRLF {
+		eol = "\r\n"
+	}
+
+	lines := bytes.Split(rec.Data, []byte("\n"))
+	for i := range lines {
+		lines[i] = bytes.TrimSuffix(lines[i], []byte("\r"))
+	}
+	if len(lines[len(lines)-1]) == 0 {
+		// Trailing line ending
+		lines = lines[:len(lines)-1]
+	}
+	header, body := lines, [][]byte(nil)
+	for i, line := range lines {
+		if len(line) == 0 {
+			header, body = lines[:i], lines[i+1:]
+			break
+		}
+	}
+
+	bwr.WriteString(strings.TrimSuffix(fromLine(rec.Data), "\n") + eol)
+	if len(labels) > 0 {
+		bwr.WriteString("X-Gmail-Labels: " + strings.Join(labels, ", ") + eol)
+	}
+	bwr.WriteString("X-Gmail-MsgID: " + strconv.FormatInt(rec.MessageID, 10) + eol)
+	if rec.ThreadID != 0 {
+		bwr.WriteString("X-GM-Thread-Id: " + strconv.FormatInt(rec.ThreadID, 10) + eol)
+	}
+	if len(flags) > 0 {
+		status, xstatus := mboxStatus(flags)
+		bwr.WriteString("Status: " + status + eol)
+		if xstatus != "" {
+			bwr.WriteString("X-Status: " + xstatus + eol)
+		}
+	}
+
+	writeLine := func(line []byte) {
+		if needsQuoting(line, format.Mboxo) {
+			bwr.Write(esc)
+		}
+		bwr.Write(line)
+		bwr.WriteString(eol)
+	}
+	// Headers written above replace those in the message, along with
+	// their continuation lines
+	var replaced []string
+	if format.ContentLength {
+		replaced = append(replaced, "content-length:")
+	}
+	if len(flags) > 0 {
+		replaced = append(replaced, "status:", "x-status:")
+	}
+	dropping := false
+	for _, line := range header {
+		if len(line) > 0 && (line[0] == ' ' || line[0] == '\t') {
+			if !dropping {
+				writeLine(line)
+			}
+			continue
+		}
+		dropping = false
+		lower := bytes.ToLower(line)
+		for _, name := range replaced {
+			if bytes.HasPrefix(lower, []byte(name)) {
+				dropping = true
+			}
+		}
+		if !dropping {
+			writeLine(line)
+		}
+	}
+	if format.ContentLength {
+		var length int
+		for _, line := range body {
+			if needsQuoting(line, format.Mboxo) {
+				length += len(esc)
+			}
+			length += len(line) + len(eol)
+		}
+		bwr.WriteString("Content-Length: " + strconv.Itoa(length) + eol)
+	}
+	bwr.WriteString(eol)
+	for _, line := range body {
+		writeLine(line)
+	}
+	bwr.WriteString(eol)
+}
+
+// writeRawMboxMessage writes rec to bwr as an mbox message with the data
+// unchanged but for the quoting of lines, ending it with a line ending if it
+// lacks one and an empty line.
+func writeRawMboxMessage(bwr *bufio.Writer, rec *db.MessageRecord, mboxo bool) {
+	bwr.WriteString(fromLine(rec.Data))
+	data := rec.Data
+	for len(data) > 0 {
+		line := data
+		if i := bytes.IndexByte(data, '\n'); i >= 0 {
+			line = data[:i+1]
+		}
+		data = data[len(line):]
+		if needsQuoting(line, mboxo) {
+			bwr.Write(esc)
+		}
+		bwr.Write(line)
+	}
+	if len(rec.Data) > 0 && rec.Data[len(rec.Data)-1] != '\n' {
+		bwr.WriteString("\n")
+	}
+	bwr.WriteString("\n")
+}
+
+// needsQuoting returns whether line is to be written with a ">" prepended:
+// lines starting with "From " and, unless mboxo, with any number of ">"
+// followed by "From ", so that readers can remove one level of quoting.
+func needsQuoting(line []byte, mboxo bool) bool {
+	if !mboxo {
+		line = bytes.TrimLeft(line, ">")
+	}
+	return bytes.HasPrefix(line, from)
+}
+
+// ReadMbox reads the mbox in rd and calls fn with the lines of each message
+// after the "From " line, without their line endings. Lines starting with
+// "From " separate messages and one level of ">" quoting is removed from
+// the lines quoted as WriteMboxMessage does with the given quoting: those
+// with any number of ">" before "From ", or with mboxo only ">From ". The
+// empty line ending each message is left in its lines.
+func ReadMbox(rd io.Reader, mboxo bool, fn func(lines [][]byte) error) error {
+	var lines [][]byte
+	inMessage := false
+	brd := bufio.NewReader(rd)
+	for {
+		line, err := brd.ReadBytes('\n')
+		if len(line) > 0 {
+			line = bytes.TrimSuffix(bytes.TrimSuffix(line, []byte("\n")), []byte("\r"))
+			switch {
+			case bytes.HasPrefix(line, from):
+				if inMessage {
+					if err := fn(lines); err != nil {
+						return err
+					}
+				}
+				lines = nil
+				inMessage = true
+			case inMessage:
+				if bytes.HasPrefix(line, esc) && needsQuoting(line[len(esc):], mboxo) {
+					line = line[len(esc):]
+				}
+				lines = append(lines, line)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if !inMessage {
+		return nil
+	}
+	return fn(lines)
+}
+
+// fromLine returns the mbox separator line for the message, as described
+// in RFC 4155. The sender is taken from the Return-Path or From header and
+// the date from the Date header, with fallbacks for when those are missing
+// or unparseable.
+func fromLine(data []byte) string {
+	sender := "MAILER-DAEMON"
+	date := time.Unix(0, 0)
+
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err == nil {
+		if rp := strings.Trim(msg.Header.Get("Return-Path"), " <>"); rp != "" && !strings.ContainsAny(rp, " \t") {
+			sender = rp
+		} else if addr, err := mail.ParseAddress(msg.Header.Get("From")); err == nil && !strings.ContainsAny(addr.Address, " \t") {
+			sender = addr.Address
+		}
+		if t, err := msg.Header.Date(); err == nil {
+			date = t
+		}
+	}
+
+	return "From " + sender + " " + date.UTC().Format(time.ANSIC) + "\n"
+}
+
+// mboxStatus returns the Status and X-Status header values for the IMAP
+// flags, as read by mutt, Thunderbird and other mbox readers: R for \Seen
+// and O for a message that is no longer new in Status, and A, F, T and D for
+// \Answered, \Flagged, \Draft and \Deleted in X-Status.
+func mboxStatus(flags []string) (status, xstatus string) {
+	have := func(flag string) bool {
+		for _, f := range flags {
+			if strings.EqualFold(f, flag) {
+				return true
+			}
+		}
+		return false
+	}
+	if have(`\Seen`) {
+		status = "R"
+	}
+	status += "O"
+	for _, f := range []struct {
+		flag string
+		code string
+	}{{`\Answered`, "A"}, {`\Flagged`, "F"}, {`\Draft`, "T"}, {`\Deleted`, "D"}} {
+		if have(f.flag) {
+			xstatus += f.code
+		}
+	}
+	return status, xstatus
+}
@@ -0,0 +1,134 @@
+package syncer
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/calmh/gmailsync/db"
+)
+
+// testVault returns a vault in memory holding the given messages, with
+// message IDs from 1.
+func testVault(t *testing.T, msgs ...string) *db.DB {
+	t.Helper()
+	vault, err := db.OpenStorage(&db.MemoryStorage{}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, msg := range msgs {
+		err = vault.WriteMessage(int64(i+1), []byte(msg))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return vault
+}
+
+// export returns the mbox written by Export for vault.
+func export(t *testing.T, vault *db.DB, opts ExportOptions) string {
+	t.Helper()
+	vault.Rewind()
+	var buf bytes.Buffer
+	s := &Syncer{Vault: vault}
+	_, err := s.Export(&buf, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func TestExportWithoutLabels(t *testing.T) {
+	vault := testVault(t, "Subject: one\n\nlabeled\n", "Subject: two\n\nunlabeled\n")
+	vault.SetLabels(1, []string{"Inbox", "Work"})
+	err := vault.WriteLabels()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mbox := export(t, vault, ExportOptions{})
+	msgs := strings.Split(mbox, "\nFrom ")
+	if len(msgs) != 2 {
+		t.Fatalf("exported %d messages, not 2:\n%s", len(msgs), mbox)
+	}
+	if !strings.Contains(msgs[0], "\nX-Gmail-Labels: Inbox, Work\n") {
+		t.Errorf("labeled message lacks its labels:\n%s", msgs[0])
+	}
+	if strings.Contains(msgs[1], "X-Gmail-Labels") {
+		t.Errorf("unlabeled message has an X-Gmail-Labels header:\n%s", msgs[1])
+	}
+	if !strings.Contains(msgs[1], "\nX-Gmail-MsgID: 2\n") {
+		t.Errorf("unlabeled message lacks its message ID:\n%s", msgs[1])
+	}
+
+	// Labels all dropped by the mapping are left out the same way
+	mbox = export(t, vault, ExportOptions{MapLabels: func([]string) []string { return nil }})
+	if strings.Contains(mbox, "X-Gmail-Labels") {
+		t.Errorf("message with its labels mapped away has an X-Gmail-Labels header:\n%s", mbox)
+	}
+}
+
+// TestMboxRoundTrip checks that ReadMbox reads back the messages written by
+// Export, with the lines starting with "From " and ">From " in their bodies.
+func TestMboxRoundTrip(t *testing.T) {
+	msgs := []string{
+		"Subject: one\r\n\r\nFrom here\r\n>From there\r\n>>From afar\r\nFrom\r\n",
+		"Subject: two\r\n\r\n>From the start\r\n",
+	}
+	cases := []struct {
+		name  string
+		mboxo bool
+		// bodies are the lines after the header read back
+		bodies [][]string
+	}{
+		{
+			name:   "mboxrd",
+			bodies: [][]string{{"From here", ">From there", ">>From afar", "From"}, {">From the start"}},
+		},
+		{
+			// Lines starting with ">From " can't be told from quoted
+			// "From " lines, and lose their ">"
+			name:   "mboxo",
+			mboxo:  true,
+			bodies: [][]string{{"From here", "From there", ">>From afar", "From"}, {"From the start"}},
+		},
+	}
+	vault := testVault(t, msgs...)
+	for _, tc := range cases {
+		for _, raw := range []bool{false, true} {
+			name := tc.name
+			if raw {
+				name += "/raw"
+			}
+			t.Run(name, func(t *testing.T) {
+				mbox := export(t, vault, ExportOptions{Format: MboxFormat{Mboxo: tc.mboxo, Raw: raw}})
+				var bodies [][]string
+				err := ReadMbox(strings.NewReader(mbox), tc.mboxo, func(lines [][]byte) error {
+					var body []string
+					inHeader := true
+					for _, line := range lines {
+						if !inHeader {
+							body = append(body, string(line))
+						}
+						inHeader = inHeader && len(line) > 0
+					}
+					// The empty line ending the message
+					if n := len(body); n == 0 || body[n-1] != "" {
+						t.Errorf("message doesn't end in an empty line: %q", body)
+					} else {
+						body = body[:n-1]
+					}
+					bodies = append(bodies, body)
+					return nil
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(bodies, tc.bodies) {
+					t.Errorf("read back bodies\n%q\nnot\n%q\nfrom:\n%s", bodies, tc.bodies, mbox)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package syncer
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/calmh/gmailsync/db"
+)
+
+// saveInterval is how often the synced UID ranges are saved while a sync
+// is running.
+const saveInterval = time.Minute
+
+// syncedRanges tracks the UID ranges of the mailbox whose messages have all
+// been stored, saving them in the vault now and then, so that an
+// interrupted sync resumes without scanning them again.
+type syncedRanges struct {
+	sync.Mutex
+	validity uint32
+	ranges   []db.ScanRange
+	saved    time.Time
+}
+
+// scanChunk is the UID range covered by one scan and the number of its
+// messages not yet stored. The range counts as synced once they all are.
+type scanChunk struct {
+	first, last uint32
+	pending     int
+	failed      bool
+}
+
+// chunkStarted returns a chunk for the UID range first to last, or nil if
+// ranges aren't being tracked. The chunk is held, along with each message
+// added to it, until released by chunkDone.
+func (s *Syncer) chunkStarted(first, last uint32) *scanChunk {
+	if s.synced == nil {
+		return nil
+	}
+	return &scanChunk{first: first, last: last, pending: 1}
+}
+
+// chunkAdded holds c for one more message.
+func (s *Syncer) chunkAdded(c *scanChunk) {
+	if c == nil {
+		return
+	}
+	s.synced.Lock()
+	c.pending++
+	s.synced.Unlock()
+}
+
+// chunkDone releases one hold on c, after a message was stored or failed
+// to be. Once released by everything, a chunk with no failures is added to
+// the synced ranges.
+func (s *Syncer) chunkDone(c *scanChunk, ok bool) {
+	if c == nil {
+		return
+	}
+	defer s.synced.Unlock()
+	s.synced.Lock()
+	if !ok {
+		c.failed = true
+	}
+	c.pending--
+	if c.pending > 0 || c.failed {
+		return
+	}
+	s.synced.ranges = mergeRanges(append(s.synced.ranges, db.ScanRange{First: int64(c.first), Last: int64(c.last)}))
+	if time.Since(s.synced.saved) > saveInterval {
+		s.saveSynced()
+	}
+}
+
+// saveSynced records the synced ranges in the vault. The caller holds the
+// lock.
+func (s *Syncer) saveSynced() {
+	err := s.Vault.SetScanned(s.synced.validity, s.synced.ranges)
+	if err != nil {
+		s.fail(err)
+		return
+	}
+	s.synced.saved = time.Now()
+}
+
+// mergeRanges returns the ranges sorted, with overlapping and adjacent
+// ones merged.
+func mergeRanges(ranges []db.ScanRange) []db.ScanRange {
+	sort.Slice(ranges, func(a, b int) bool { return ranges[a].First < ranges[b].First })
+	var res []db.ScanRange
+	for _, r := range ranges {
+		if n := len(res); n > 0 && r.First <= res[n-1].Last+1 {
+			if r.Last > res[n-1].Last {
+				res[n-1].Last = r.Last
+			}
+			continue
+		}
+		res = append(res, r)
+	}
+	return res
+}
+
+// gaps returns the parts of first to last not covered by the merged ranges.
+func gaps(ranges []db.ScanRange, first, last uint32) []span {
+	var res []span
+	next := int64(first)
+	for _, r := range ranges {
+		if r.First > next {
+			end := r.First - 1
+			if end > int64(last) {
+				end = int64(last)
+			}
+			if end >= next {
+				res = append(res, span{uint32(next), uint32(end)})
+			}
+		}
+		if r.Last+1 > next {
+			next = r.Last + 1
+		}
+	}
+	if next <= int64(last) {
+		res = append(res, span{uint32(next), last})
+	}
+	return res
+}
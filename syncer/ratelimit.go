@@ -0,0 +1,79 @@
+package syncer
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/time/rate"
+)
+
+// A Limiter limits the rate of message fetches across all connections,
+// either in messages or in bytes per second. A nil *Limiter does not
+// limit anything.
+type Limiter struct {
+	messages *rate.Limiter
+	bytes    *rate.Limiter
+}
+
+// NewLimiter parses a rate limit such as "5" (messages per second) or
+// "500kB" (bytes per second). An empty string means no limit.
+func NewLimiter(limit string) (*Limiter, error) {
+	s := strings.TrimSpace(limit)
+	if s == "" {
+		return nil, nil
+	}
+
+	mult := 0
+	for _, suffix := range []struct {
+		s    string
+		mult int
+	}{{"MB", 1 << 20}, {"kB", 1 << 10}, {"B", 1}} {
+		if strings.HasSuffix(s, suffix.s) {
+			s = strings.TrimSpace(strings.TrimSuffix(s, suffix.s))
+			mult = suffix.mult
+			break
+		}
+	}
+
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || v <= 0 {
+		return nil, fmt.Errorf("invalid rate limit %q", limit)
+	}
+
+	if mult == 0 {
+		return &Limiter{messages: rate.NewLimiter(rate.Limit(v), 1)}, nil
+	}
+	bps := v * float64(mult)
+	return &Limiter{bytes: rate.NewLimiter(rate.Limit(bps), int(bps)+1)}, nil
+}
+
+// beforeFetch blocks until another message may be fetched or ctx is
+// cancelled.
+func (l *Limiter) beforeFetch(ctx context.Context) {
+	if l == nil || l.messages == nil {
+		return
+	}
+	l.messages.Wait(ctx)
+}
+
+// afterFetch accounts for n fetched bytes, blocking until they fit within
+// the limit or ctx is cancelled.
+func (l *Limiter) afterFetch(ctx context.Context, n int) {
+	if l == nil || l.bytes == nil {
+		return
+	}
+	// WaitN refuses requests larger than the burst size
+	burst := l.bytes.Burst()
+	for n > 0 {
+		chunk := n
+		if chunk > burst {
+			chunk = burst
+		}
+		if l.bytes.WaitN(ctx, chunk) != nil {
+			return
+		}
+		n -= chunk
+	}
+}
@@ -0,0 +1,171 @@
+package syncer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/calmh/gmailsync/imap"
+)
+
+// fakeServer is a mailbox in memory standing in for the IMAP server.
+type fakeServer struct {
+	mut sync.Mutex
+	// msgs are the messages in the mailbox in the order of their UIDs, so
+	// that the sequence number of msgs[i] is i+1
+	msgs     []fakeMessage
+	gmail    bool
+	validity uint32
+	// failing are the UIDs of the messages that can't be fetched
+	failing map[uint32]bool
+	// searches are the ranges searched by sequence number, and fetched
+	// the UIDs whose bodies were fetched
+	searches []string
+	fetched  []uint32
+}
+
+type fakeMessage struct {
+	uid    uint32
+	msgid  int64
+	labels []string
+	flags  []string
+	body   string
+}
+
+// newFakeServer returns a Gmail server with n messages, whose UIDs are
+// spaced out so that they differ from their sequence numbers.
+func newFakeServer(n int) *fakeServer {
+	srv := &fakeServer{gmail: true, validity: 1, failing: make(map[uint32]bool)}
+	for i := 1; i <= n; i++ {
+		srv.msgs = append(srv.msgs, fakeMessage{
+			uid:    uint32(10 + 3*i),
+			msgid:  int64(1000 + i),
+			labels: []string{`\Inbox`},
+			flags:  []string{`\Seen`},
+			body:   fmt.Sprintf("Subject: message %d\r\n\r\nbody %d\r\n", i, i),
+		})
+	}
+	return srv
+}
+
+func (srv *fakeServer) dial(mailbox string) (*conn, error) {
+	defer srv.mut.Unlock()
+	srv.mut.Lock()
+	status := mailboxStatus{Messages: uint32(len(srv.msgs)), UIDValidity: srv.validity, UIDNext: 1}
+	if n := len(srv.msgs); n > 0 {
+		status.UIDNext = srv.msgs[n-1].uid + 1
+	}
+	return &conn{srv, status, srv.gmail}, nil
+}
+
+func (srv *fakeServer) msgID(m fakeMessage) imap.MsgID {
+	if !srv.gmail {
+		return imap.MsgID{UID: m.uid, MsgID: int64(srv.validity)<<32 | int64(m.uid), Flags: m.flags}
+	}
+	return imap.MsgID{UID: m.uid, MsgID: m.msgid, Labels: m.labels, ThreadID: m.msgid, Flags: m.flags}
+}
+
+func (srv *fakeServer) find(uid uint32) (fakeMessage, bool) {
+	for _, m := range srv.msgs {
+		if m.uid == uid {
+			return m, true
+		}
+	}
+	return fakeMessage{}, false
+}
+
+// MsgIDSearch fails for a range beyond the last message, as servers do.
+func (srv *fakeServer) MsgIDSearch(ctx context.Context, first, last uint32) ([]imap.MsgID, error) {
+	defer srv.mut.Unlock()
+	srv.mut.Lock()
+	srv.searches = append(srv.searches, fmt.Sprintf("%d:%d", first, last))
+	if first < 1 || int(first) > len(srv.msgs) {
+		return nil, errors.New("BAD invalid sequence set")
+	}
+	var res []imap.MsgID
+	for i := first; i <= last && int(i) <= len(srv.msgs); i++ {
+		res = append(res, srv.msgID(srv.msgs[i-1]))
+	}
+	return res, nil
+}
+
+func (srv *fakeServer) UIDMsgIDSearch(ctx context.Context, first, last uint32) ([]imap.MsgID, error) {
+	defer srv.mut.Unlock()
+	srv.mut.Lock()
+	var res []imap.MsgID
+	for _, m := range srv.msgs {
+		if m.uid >= first && m.uid <= last {
+			res = append(res, srv.msgID(m))
+		}
+	}
+	return res, nil
+}
+
+func (srv *fakeServer) SearchDate(ctx context.Context, since, before time.Time) ([]uint32, error) {
+	defer srv.mut.Unlock()
+	srv.mut.Lock()
+	var res []uint32
+	for _, m := range srv.msgs {
+		res = append(res, m.uid)
+	}
+	return res, nil
+}
+
+func (srv *fakeServer) SearchMsgIDs(ctx context.Context, msgids []int64) ([]uint32, error) {
+	defer srv.mut.Unlock()
+	srv.mut.Lock()
+	var res []uint32
+	for _, m := range srv.msgs {
+		for _, msgid := range msgids {
+			if m.msgid == msgid {
+				res = append(res, m.uid)
+			}
+		}
+	}
+	return res, nil
+}
+
+// GetMails fails as a whole if any of the messages is failing.
+func (srv *fakeServer) GetMails(ctx context.Context, uids []uint32) (map[uint32][]byte, error) {
+	defer srv.mut.Unlock()
+	srv.mut.Lock()
+	for _, uid := range uids {
+		if srv.failing[uid] {
+			return nil, fmt.Errorf("NO cannot fetch UID %d", uid)
+		}
+	}
+	res := make(map[uint32][]byte)
+	for _, uid := range uids {
+		if m, ok := srv.find(uid); ok {
+			res[uid] = []byte(m.body)
+			srv.fetched = append(srv.fetched, uid)
+		}
+	}
+	return res, nil
+}
+
+func (srv *fakeServer) GetMailSizes(ctx context.Context, uids []uint32) (map[uint32]uint32, error) {
+	defer srv.mut.Unlock()
+	srv.mut.Lock()
+	res := make(map[uint32]uint32)
+	for _, uid := range uids {
+		if m, ok := srv.find(uid); ok {
+			res[uid] = uint32(len(m.body))
+		}
+	}
+	return res, nil
+}
+
+func (srv *fakeServer) GetEnvelope(ctx context.Context, uid uint32) (*imap.Envelope, error) {
+	defer srv.mut.Unlock()
+	srv.mut.Lock()
+	m, ok := srv.find(uid)
+	if !ok {
+		return nil, imap.ErrNoMessage
+	}
+	subject := strings.TrimPrefix(strings.SplitN(m.body, "\r\n", 2)[0], "Subject: ")
+	return &imap.Envelope{Subject: subject, Size: uint32(len(m.body))}, nil
+}
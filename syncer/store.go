@@ -0,0 +1,275 @@
+package syncer
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/calmh/gmailsync/db"
+	"github.com/calmh/gmailsync/imap"
+)
+
+// fetchBatchSize is the largest number of messages fetched with one command.
+const fetchBatchSize = 20
+
+func (s *Syncer) fetchAndStore(ctx context.Context, id int, mailbox string, msgids chan msgID, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	s.Log.Debugf("IMAP[%d]: Connect", id)
+
+	client, err := s.connect(mailbox)
+	if err != nil {
+		s.fail(err)
+		return
+	}
+	defer s.released()
+
+	s.Log.Debugf("IMAP[%d]: Ready", id)
+
+	s.store(ctx, client, id, msgids)
+}
+
+// connect connects to mailbox, counting the connection as in use until
+// released is called.
+func (s *Syncer) connect(mailbox string) (*conn, error) {
+	var c *conn
+	var err error
+	if s.dial != nil {
+		c, err = s.dial(mailbox)
+	} else {
+		var client *imap.IMAPClient
+		client, err = s.Connect(mailbox)
+		if err == nil {
+			mb := client.Mailbox
+			c = &conn{client, mailboxStatus{mb.Messages, mb.UIDValidity, mb.UIDNext}, client.Gmail}
+		}
+	}
+	if err == nil {
+		s.update(func(p *Progress) {
+			p.Connections++
+		})
+	}
+	return c, err
+}
+
+func (s *Syncer) released() {
+	s.update(func(p *Progress) {
+		p.Connections--
+	})
+}
+
+// mailFetcher is the part of the IMAP client used to fetch messages.
+type mailFetcher interface {
+	GetMails(ctx context.Context, uids []uint32) (map[uint32][]byte, error)
+	GetMailSizes(ctx context.Context, uids []uint32) (map[uint32]uint32, error)
+	GetEnvelope(ctx context.Context, uid uint32) (*imap.Envelope, error)
+}
+
+// mailClient is the part of the IMAP client used by a sync, so that a fake
+// server can stand in for it.
+type mailClient interface {
+	mailFetcher
+	MsgIDSearch(ctx context.Context, first, last uint32) ([]imap.MsgID, error)
+	UIDMsgIDSearch(ctx context.Context, first, last uint32) ([]imap.MsgID, error)
+	SearchDate(ctx context.Context, since, before time.Time) ([]uint32, error)
+	SearchMsgIDs(ctx context.Context, msgids []int64) ([]uint32, error)
+}
+
+// conn is a connection with a mailbox selected.
+type conn struct {
+	mailClient
+	Mailbox mailboxStatus
+	// Gmail is set when the server has the Gmail extensions
+	Gmail bool
+}
+
+// mailboxStatus is the status of a mailbox when it was selected.
+type mailboxStatus struct {
+	Messages    uint32
+	UIDValidity uint32
+	UIDNext     uint32
+}
+
+// store fetches the messages from msgids until the channel is closed or ctx
+// is cancelled and writes them to the vault.
+func (s *Syncer) store(ctx context.Context, client mailFetcher, id int, msgids chan msgID) {
+	for {
+		batch := nextBatch(msgids, fetchBatchSize)
+		if len(batch) == 0 || ctx.Err() != nil {
+			return
+		}
+
+		// The sizes of the whole batch are fetched with one command
+		var sizes map[uint32]uint32
+		if !s.HeadersOnly && s.MaxMessageBytes > 0 {
+			uids := make([]uint32, len(batch))
+			for i, msgid := range batch {
+				uids[i] = msgid.UID
+			}
+			s.Log.Debugf("IMAP[%d]: UID FETCH %v RFC822.SIZE", id, uids)
+			var err error
+			sizes, err = client.GetMailSizes(ctx, uids)
+			if err != nil && ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				for _, msgid := range batch {
+					s.fetchFailed(msgid, err)
+				}
+				continue
+			}
+		}
+
+		var bodies []msgID
+		for _, msgid := range batch {
+			s.Limiter.beforeFetch(ctx)
+			headers := s.HeadersOnly
+			if sizes != nil {
+				size, ok := sizes[msgid.UID]
+				if !ok {
+					s.Log.Warnf("Message %d (UID %d) disappeared before it could be fetched", msgid.MsgID, msgid.UID)
+					s.chunkDone(msgid.chunk, true)
+					continue
+				}
+				if int64(size) > s.MaxMessageBytes {
+					if s.Vault.HaveHeader(msgid.MsgID) {
+						s.chunkDone(msgid.chunk, true)
+						continue
+					}
+					s.Log.Infof("Message %d is %d bytes; storing headers only", msgid.MsgID, size)
+					headers = true
+				}
+			}
+			if !headers {
+				bodies = append(bodies, msgid)
+				continue
+			}
+
+			s.Log.Debugf("IMAP[%d]: UID FETCH %d ENVELOPE", id, msgid.UID)
+			env, err := client.GetEnvelope(ctx, msgid.UID)
+			if err != nil && ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				s.fetchFailed(msgid, err)
+				continue
+			}
+
+			header := env.Header()
+			err = s.Vault.WriteHeaderRecord(msgid.MsgID, int64(env.Size), header)
+			if err != nil {
+				s.fail(err)
+				return
+			}
+			s.update(func(p *Progress) {
+				p.Fetched++
+				p.Bytes += int64(len(header))
+			})
+			s.chunkDone(msgid.chunk, true)
+		}
+		if len(bodies) == 0 {
+			continue
+		}
+
+		uids := make([]uint32, len(bodies))
+		for i, msgid := range bodies {
+			uids[i] = msgid.UID
+		}
+		s.Log.Debugf("IMAP[%d]: UID FETCH %v", id, uids)
+		mails, err := client.GetMails(ctx, uids)
+		if err != nil && ctx.Err() != nil {
+			return
+		}
+		if err != nil && len(bodies) == 1 {
+			s.fetchFailed(bodies[0], err)
+			continue
+		}
+		if err != nil {
+			// Find the message at fault by fetching them one by one
+			s.Log.Debugf("IMAP[%d]: UID FETCH %v: %v", id, uids, err)
+			mails = make(map[uint32][]byte)
+			for _, msgid := range bodies {
+				one, err := client.GetMails(ctx, []uint32{msgid.UID})
+				if err != nil && ctx.Err() != nil {
+					return
+				}
+				if err != nil {
+					s.fetchFailed(msgid, err)
+					continue
+				}
+				for uid, body := range one {
+					mails[uid] = body
+				}
+			}
+		}
+
+		for _, msgid := range bodies {
+			body, ok := mails[msgid.UID]
+			if !ok {
+				if !s.hasFailed(msgid) {
+					s.Log.Warnf("Message %d (UID %d) disappeared before it could be fetched", msgid.MsgID, msgid.UID)
+					s.chunkDone(msgid.chunk, true)
+				}
+				continue
+			}
+			s.Limiter.afterFetch(ctx, len(body))
+
+			err = s.Vault.WriteMessageRecord(db.MessageRecord{MessageID: msgid.MsgID, Data: body, ThreadID: msgid.ThreadID})
+			if err != nil {
+				s.fail(err)
+				return
+			}
+			s.update(func(p *Progress) {
+				p.Fetched++
+				p.Bytes += int64(len(body))
+			})
+			s.chunkDone(msgid.chunk, true)
+		}
+	}
+}
+
+// fetchFailed records that msgid could not be fetched, so that the sync can
+// go on with the other messages, or when strict fails the sync.
+func (s *Syncer) fetchFailed(msgid msgID, err error) {
+	s.chunkDone(msgid.chunk, false)
+	if s.Strict {
+		s.fail(err)
+		return
+	}
+	s.Log.Warnf("Skipping message %d (UID %d): %v", msgid.MsgID, msgid.UID, err)
+	s.update(func(p *Progress) {
+		p.Failed = append(p.Failed, Failure{msgid.UID, msgid.MsgID, err})
+	})
+}
+
+func (s *Syncer) hasFailed(msgid msgID) bool {
+	for _, f := range s.Progress().Failed {
+		if f.UID == msgid.UID && f.MsgID == msgid.MsgID {
+			return true
+		}
+	}
+	return false
+}
+
+// nextBatch waits for a message to fetch and returns it along with up to
+// max-1 more that are already waiting. The batch is empty when the channel
+// is closed.
+func nextBatch(msgids chan msgID, max int) []msgID {
+	msgid, ok := <-msgids
+	if !ok {
+		return nil
+	}
+	batch := []msgID{msgid}
+	for len(batch) < max {
+		select {
+		case msgid, ok := <-msgids:
+			if !ok {
+				return batch
+			}
+			batch = append(batch, msgid)
+		default:
+			return batch
+		}
+	}
+	return batch
+}
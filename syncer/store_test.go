@@ -0,0 +1,93 @@
+package syncer
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+// queued returns a closed channel holding the messages of srv.
+func queued(srv *fakeServer) chan msgID {
+	ch := make(chan msgID, len(srv.msgs))
+	for _, m := range srv.msgs {
+		ch <- msgID{UID: m.uid, MsgID: m.msgid, ThreadID: m.msgid}
+	}
+	close(ch)
+	return ch
+}
+
+func TestStore(t *testing.T) {
+	srv := newFakeServer(5)
+	// The third message can't be fetched and the last is deleted after
+	// the scan found it
+	srv.failing[srv.msgs[2].uid] = true
+	msgids := queued(srv)
+	gone := srv.msgs[4]
+	srv.msgs = srv.msgs[:4]
+
+	vault := testVault(t)
+	s := &Syncer{Vault: vault, Log: nopLogger{}, cancel: func() {}}
+	s.store(context.Background(), srv, 1, msgids)
+
+	for i, m := range srv.msgs {
+		if have := vault.HaveUID(m.msgid); have != (i != 2) {
+			t.Errorf("message %d stored: %v", i+1, have)
+		}
+	}
+	if vault.HaveUID(gone.msgid) {
+		t.Error("deleted message stored")
+	}
+	failed := s.Progress().Failed
+	if len(failed) != 1 || failed[0].UID != srv.msgs[2].uid {
+		t.Errorf("failed messages are %v, not only the third", failed)
+	}
+	if err := s.failed(); err != nil {
+		t.Errorf("sync failed: %v", err)
+	}
+
+	vault.Rewind()
+	for {
+		rec, err := vault.ReadMessage()
+		if err != nil {
+			break
+		}
+		if want := "Subject: message "; !strings.HasPrefix(string(rec.Data), want) || rec.ThreadID != rec.MessageID {
+			t.Errorf("message %d stored as %q with thread %d", rec.MessageID, rec.Data, rec.ThreadID)
+		}
+	}
+}
+
+func TestStoreStrict(t *testing.T) {
+	srv := newFakeServer(3)
+	srv.failing[srv.msgs[1].uid] = true
+
+	s := &Syncer{Vault: testVault(t), Log: nopLogger{}, Strict: true, cancel: func() {}}
+	s.store(context.Background(), srv, 1, queued(srv))
+	if err := s.failed(); err == nil {
+		t.Error("strict sync did not fail on a message that can't be fetched")
+	}
+}
+
+func TestStoreMaxMessageBytes(t *testing.T) {
+	srv := newFakeServer(3)
+	srv.msgs[1].body = "Subject: message 2\r\n\r\n" + strings.Repeat("attachment\r\n", 100)
+
+	vault := testVault(t)
+	s := &Syncer{Vault: vault, Log: nopLogger{}, MaxMessageBytes: 1000, cancel: func() {}}
+	s.store(context.Background(), srv, 1, queued(srv))
+
+	big := srv.msgs[1].msgid
+	if vault.HaveUID(big) || !vault.HaveHeader(big) {
+		t.Errorf("large message stored with body %v, headers %v; want headers only", vault.HaveUID(big), vault.HaveHeader(big))
+	}
+	for _, m := range []fakeMessage{srv.msgs[0], srv.msgs[2]} {
+		if !vault.HaveUID(m.msgid) {
+			t.Errorf("message %d not stored", m.msgid)
+		}
+	}
+	for _, uid := range srv.fetched {
+		if uid == srv.msgs[1].uid {
+			t.Error("body of large message fetched")
+		}
+	}
+}
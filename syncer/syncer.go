@@ -0,0 +1,879 @@
+// Package syncer syncs a mailbox to a vault and exports the vault, for use
+// by the gmailsync command or by programs embedding it.
+package syncer
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/calmh/gmailsync/db"
+	"github.com/calmh/gmailsync/imap"
+)
+
+// DefaultQueueSize is the fetch queue size used when QueueSize is zero.
+const DefaultQueueSize = 100
+
+// The scan steps used when ScanStep, MinScanStep and MaxScanStep are zero.
+const (
+	DefaultScanStep    = 100
+	DefaultMinScanStep = 100
+	DefaultMaxScanStep = 3200
+)
+
+// IndexInterval is the number of new message records after which Fetch
+// writes an index record, to speed up opening the vault.
+const IndexInterval = 1000
+
+// A Syncer fetches the messages of one or more mailboxes into a vault. The
+// fields are set before calling Fetch and not changed while it runs.
+type Syncer struct {
+	Vault *db.DB
+	// Connect returns a new connection with the given mailbox selected,
+	// or the default mailbox if the name is empty. It is called once for
+	// each connection.
+	Connect func(mailbox string) (*imap.IMAPClient, error)
+	// Mailboxes are the mailboxes synced, one after the other. If there
+	// is more than one, the vault can't record how far each has been
+	// scanned, so every fetch scans all of them. If empty, the default
+	// mailbox is synced.
+	Mailboxes []string
+	// Connections is the total number of connections, of which
+	// ScanConnections scan the mailbox and the rest fetch messages.
+	Connections     int
+	ScanConnections int
+	// QueueSize is the number of new messages found by the scan that may
+	// wait to be fetched. Scanning pauses while the queue is full, so that
+	// it keeps pace with the fetching. Defaults to DefaultQueueSize.
+	QueueSize int
+	// ScanStep is the number of messages searched by the first command of
+	// a scan. The step doubles after each chunk without new messages, up
+	// to MaxScanStep, and halves after each with new messages, down to
+	// MinScanStep. They default to DefaultScanStep, DefaultMinScanStep
+	// and DefaultMaxScanStep.
+	ScanStep    int
+	MinScanStep int
+	MaxScanStep int
+	// FullScan rescans the whole mailbox instead of resuming after the
+	// watermark stored in the vault.
+	FullScan bool
+	// ExcludeLabels are labels not synced. Messages whose labels are all
+	// excluded are not fetched, and the excluded labels are left out of
+	// the labels stored for the others. Labels are compared ignoring case
+	// and the leading backslash of system labels such as \Spam.
+	ExcludeLabels []string
+	// Since and Before, if not zero, limit the sync to the messages
+	// received on or after the date of Since and before that of Before,
+	// as found by a search instead of a scan of the mailbox. The
+	// watermark is left as it is.
+	Since  time.Time
+	Before time.Time
+	// Backfill fetches the bodies of the messages stored headers only,
+	// found by a search for their message IDs, instead of scanning the
+	// mailbox for new messages. MaxMessageBytes still applies. The
+	// watermark is left as it is.
+	Backfill bool
+	// Prune records the deletion of messages no longer in the mailbox. It
+	// implies a full scan.
+	Prune bool
+	// HeadersOnly stores only the headers of new messages.
+	HeadersOnly bool
+	// MaxMessageBytes, if nonzero, is the size above which only the
+	// headers of a message are stored.
+	MaxMessageBytes int64
+	// NewestFirst scans the mailbox from the end, so that the newest
+	// messages are fetched first.
+	NewestFirst bool
+	// DryRun scans the mailbox without changing the vault. The progress
+	// tells what would have been fetched, relabeled and pruned.
+	DryRun bool
+	// Strict fails the sync at the first message that can't be fetched,
+	// instead of skipping it.
+	Strict bool
+	// Limiter, if not nil, limits the rate of fetches.
+	Limiter *Limiter
+	Log     Logger
+	// OnProgress, if not nil, is called with the current progress every
+	// time it changes. Calls may come from several goroutines at once.
+	OnProgress func(Progress)
+
+	mut      sync.Mutex
+	progress Progress
+	err      error
+	cancel   context.CancelFunc
+	// synced tracks the UID ranges completely synced, or is nil if they
+	// aren't recorded
+	synced *syncedRanges
+	// dial, if set, is used instead of Connect, so that tests can use a
+	// fake server
+	dial func(mailbox string) (*conn, error)
+}
+
+// Progress describes how far a Fetch has come.
+type Progress struct {
+	Started time.Time
+	// ToScan is the number of messages to scan, and Scanned the number
+	// scanned so far
+	ToScan   int
+	Scanned  int
+	ScanDone bool
+	// Queued is the number of new messages found by the scan, and Fetched
+	// and Bytes the number of them stored so far and their size
+	Queued  int
+	Fetched int
+	Bytes   int64
+	// Labels is the number of messages with changed labels or flags
+	Labels int
+	// Pruned is the number of messages deleted from the vault, or to be
+	// deleted for a dry run
+	Pruned int
+	// Failed are the messages that could not be fetched
+	Failed []Failure
+	// Connections is the number of IMAP connections in use
+	Connections int
+}
+
+// Failure is a message that could not be fetched.
+type Failure struct {
+	UID   uint32
+	MsgID int64
+	Err   error
+}
+
+// Logger receives the log output of a Syncer.
+type Logger interface {
+	Debugf(format string, v ...interface{})
+	Infof(format string, v ...interface{})
+	Warnf(format string, v ...interface{})
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Debugf(format string, v ...interface{}) {}
+func (nopLogger) Infof(format string, v ...interface{})  {}
+func (nopLogger) Warnf(format string, v ...interface{})  {}
+
+type msgID struct {
+	UID      uint32
+	MsgID    int64
+	ThreadID int64
+	// chunk is the scan chunk the message was found by
+	chunk *scanChunk
+}
+
+// Progress returns the current progress.
+func (s *Syncer) Progress() Progress {
+	defer s.mut.Unlock()
+	s.mut.Lock()
+	return s.progress
+}
+
+func (s *Syncer) update(f func(p *Progress)) {
+	s.mut.Lock()
+	f(&s.progress)
+	p := s.progress
+	s.mut.Unlock()
+	if s.OnProgress != nil {
+		s.OnProgress(p)
+	}
+}
+
+// fail ends the sync with err, unless it has already failed.
+func (s *Syncer) fail(err error) {
+	s.mut.Lock()
+	if s.err == nil {
+		s.err = err
+	}
+	s.mut.Unlock()
+	s.cancel()
+}
+
+func (s *Syncer) failed() error {
+	defer s.mut.Unlock()
+	s.mut.Lock()
+	return s.err
+}
+
+// Fetch scans the mailbox for new messages and label changes and stores
+// them in the vault. When ctx is cancelled the messages being fetched are
+// completed and Fetch returns ctx.Err() without moving the watermark. Fetch
+// doesn't close the vault.
+func (s *Syncer) Fetch(ctx context.Context) error {
+	if s.Log == nil {
+		s.Log = nopLogger{}
+	}
+	if s.ScanConnections < 1 || s.Connections <= s.ScanConnections {
+		return errors.New("At least one scan and one fetch connection are needed")
+	}
+	if s.Prune && s.window() {
+		return errors.New("Pruning needs a scan of the whole mailbox, not of a date range or backfill")
+	}
+	if s.Backfill && s.HeadersOnly {
+		return errors.New("Backfill fetches bodies, not headers only")
+	}
+
+	parent := ctx
+	ctx, s.cancel = context.WithCancel(ctx)
+	defer s.cancel()
+	s.mut.Lock()
+	s.err = nil
+	s.mut.Unlock()
+	s.update(func(p *Progress) {
+		*p = Progress{Started: time.Now()}
+	})
+
+	mailboxes := s.Mailboxes
+	if len(mailboxes) == 0 {
+		mailboxes = []string{""}
+	}
+	var wm *watermark
+	var seen map[int64]bool
+	if s.Prune {
+		seen = make(map[int64]bool)
+	}
+	for _, mailbox := range mailboxes {
+		if len(mailboxes) > 1 {
+			s.Log.Infof("Syncing mailbox %s", mailbox)
+		}
+		var err error
+		wm, err = s.fetchMailbox(ctx, mailbox, len(mailboxes) == 1)
+		if err != nil {
+			return err
+		}
+		for msgid := range wm.seen {
+			seen[msgid] = true
+		}
+		if parent.Err() != nil {
+			break
+		}
+	}
+
+	if s.DryRun {
+		if s.Prune && parent.Err() == nil {
+			s.pruneDeleted(seen)
+		}
+		return s.failed()
+	}
+
+	err := s.Vault.WriteLabels()
+	if err != nil {
+		return err
+	}
+
+	if parent.Err() != nil {
+		// Messages up to the watermark may not have been fetched
+		return parent.Err()
+	}
+
+	if s.Prune {
+		s.pruneDeleted(seen)
+		if err := s.failed(); err != nil {
+			return err
+		}
+	}
+
+	failed := s.Progress().Failed
+	if len(failed) > 0 {
+		s.Log.Warnf("%d messages could not be fetched and will be retried on the next fetch:", len(failed))
+		for _, f := range failed {
+			s.Log.Warnf("  message %d (UID %d): %v", f.MsgID, f.UID, f.Err)
+		}
+	}
+
+	// The bodies of messages fetched headers only are still to be
+	// fetched, and failed messages are to be retried, so the watermark
+	// must not move past them. A single watermark can't describe several
+	// mailboxes.
+	if !s.HeadersOnly && !s.window() && len(failed) == 0 && len(mailboxes) == 1 {
+		err = s.Vault.SetWatermark(wm.validity, wm.uid)
+		if err != nil {
+			return err
+		}
+		// The watermark covers the ranges synced
+		err = s.Vault.SetScanned(0, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	if s.Vault.Unindexed() >= IndexInterval {
+		err = s.Vault.WriteIndex()
+		if err != nil {
+			return err
+		}
+	}
+
+	return s.Vault.SetUpdated()
+}
+
+// fetchMailbox scans mailbox and fetches the new messages found, returning
+// once they have all been stored or ctx is cancelled. The scan resumes
+// after the watermark stored in the vault only if resume is set.
+func (s *Syncer) fetchMailbox(ctx context.Context, mailbox string, resume bool) (*watermark, error) {
+	uids, wm, err := s.findNewUIDs(ctx, mailbox, resume)
+	if err != nil {
+		return nil, err
+	}
+
+	if !s.DryRun {
+		var wg sync.WaitGroup
+		for i := s.ScanConnections; i < s.Connections; i++ {
+			wg.Add(1)
+			go s.fetchAndStore(ctx, i, mailbox, uids, &wg)
+		}
+		wg.Wait()
+	}
+	// Wait for the scanners to finish writing labels
+	for range uids {
+	}
+	if s.synced != nil {
+		s.synced.Lock()
+		s.saveSynced()
+		s.synced.Unlock()
+	}
+	return wm, s.failed()
+}
+
+type watermark struct {
+	sync.Mutex
+	validity uint32
+	uid      uint32
+	// seen holds the message IDs found by the scan, when pruning
+	seen map[int64]bool
+}
+
+func (wm *watermark) update(msgid imap.MsgID) {
+	defer wm.Unlock()
+	wm.Lock()
+	if msgid.UID > wm.uid {
+		wm.uid = msgid.UID
+	}
+	if wm.seen != nil {
+		wm.seen[msgid.MsgID] = true
+	}
+}
+
+// span is an inclusive range of message sequence numbers or UIDs.
+type span struct {
+	first, last uint32
+}
+
+// scanCursor hands out chunks of the spans to scan to the scanners, each of
+// which asks for a chunk size according to its own adaptive step.
+type scanCursor struct {
+	sync.Mutex
+	spans []span
+	// reverse hands out chunks from the end of the last span down
+	reverse bool
+	// only, if not nil, holds the UIDs to scan within the spans
+	only map[uint32]bool
+}
+
+// next returns the next chunk of at most step numbers within one span,
+// inclusive.
+func (c *scanCursor) next(step uint32) (begin, end uint32, ok bool) {
+	defer c.Unlock()
+	c.Lock()
+	if len(c.spans) == 0 {
+		return 0, 0, false
+	}
+	if c.reverse {
+		sp := &c.spans[len(c.spans)-1]
+		begin, end = sp.first, sp.last
+		if end-begin >= step {
+			begin = end - step + 1
+		}
+		if begin == sp.first {
+			c.spans = c.spans[:len(c.spans)-1]
+		} else {
+			sp.last = begin - 1
+		}
+		return begin, end, true
+	}
+	sp := &c.spans[0]
+	begin, end = sp.first, sp.last
+	if end-begin >= step {
+		end = begin + step - 1
+	}
+	if end == sp.last {
+		c.spans = c.spans[1:]
+	} else {
+		sp.first = end + 1
+	}
+	return begin, end, true
+}
+
+// size returns the number of sequence numbers or UIDs left to hand out.
+func (c *scanCursor) size() int {
+	defer c.Unlock()
+	c.Lock()
+	if c.only != nil {
+		return len(c.only)
+	}
+	n := 0
+	for _, sp := range c.spans {
+		n += int(sp.last-sp.first) + 1
+	}
+	return n
+}
+
+// findNewUIDs scans mailbox for messages not in the vault using the scan
+// connections, updating labels as it goes. The returned watermark is valid
+// once the channel is closed. If resume is set the scan skips the UIDs up to
+// the watermark stored in the vault and the ranges recorded as synced by an
+// interrupted sync, unless a full scan is requested or the mailbox
+// UIDVALIDITY has changed; label changes on the skipped messages are only
+// seen on full scans.
+func (s *Syncer) findNewUIDs(ctx context.Context, mailbox string, resume bool) (chan msgID, *watermark, error) {
+	s.Log.Debugf("IMAP[0]: Connect")
+
+	client, err := s.connect(mailbox)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	s.Log.Debugf("IMAP[0]: %d messages in mailbox", client.Mailbox.Messages)
+	if !client.Gmail {
+		s.Log.Warnf("Server lacks Gmail extensions; labels will not be synced")
+	}
+
+	validity, lastUID := s.Vault.Watermark()
+	wm := &watermark{validity: client.Mailbox.UIDValidity}
+	cursor := &scanCursor{reverse: s.NewestFirst}
+	if client.Mailbox.Messages > 0 {
+		cursor.spans = []span{{1, client.Mailbox.Messages}}
+	}
+	byUID := false
+	if s.Prune {
+		wm.seen = make(map[int64]bool)
+	}
+	if validity != 0 && validity != client.Mailbox.UIDValidity && resume {
+		// UIDs from before the change mean nothing now; message IDs on
+		// Gmail don't depend on them, so a full scan reconciles the vault
+		s.Log.Warnf("Mailbox UIDVALIDITY changed from %d to %d; discarding the watermark and scanning the whole mailbox", validity, client.Mailbox.UIDValidity)
+		if !client.Gmail {
+			s.Log.Warnf("Without Gmail message IDs, messages are identified by UIDVALIDITY and UID, so all messages will be fetched again; fetch -prune removes the old copies")
+		}
+	}
+
+	var done []db.ScanRange
+	if lastUID > 0 && validity == client.Mailbox.UIDValidity {
+		done = append(done, db.ScanRange{First: 1, Last: int64(lastUID)})
+	}
+	if v, ranges := s.Vault.Scanned(); v == client.Mailbox.UIDValidity {
+		done = append(done, ranges...)
+	}
+	done = mergeRanges(done)
+
+	s.synced = nil
+	if resume && !s.DryRun && !s.HeadersOnly && !s.window() {
+		s.synced = &syncedRanges{validity: client.Mailbox.UIDValidity, ranges: done, saved: time.Now()}
+	}
+
+	if resume && !s.FullScan && !s.Prune && !s.window() && len(done) > 0 && client.Mailbox.UIDNext > 0 {
+		if len(done) == 1 && done[0].First == 1 {
+			s.Log.Infof("Resuming scan after UID %d", done[0].Last)
+		} else {
+			s.Log.Infof("Resuming scan, skipping %d ranges of UIDs already synced", len(done))
+		}
+		cursor.spans = gaps(done, 1, client.Mailbox.UIDNext-1)
+		byUID = true
+		if last := done[len(done)-1].Last; last < int64(client.Mailbox.UIDNext) {
+			wm.uid = uint32(last)
+		}
+	}
+
+	if s.window() && client.Mailbox.Messages > 0 {
+		uids, err := s.searchWindow(ctx, client)
+		if err != nil {
+			s.released()
+			return nil, nil, err
+		}
+		// The UIDs found are scanned in one span from the lowest to the
+		// highest, which on Gmail holds few others as UIDs follow the
+		// order of arrival
+		cursor.spans, cursor.only = nil, make(map[uint32]bool)
+		for _, uid := range uids {
+			cursor.only[uid] = true
+			if len(cursor.spans) == 0 {
+				cursor.spans = []span{{uid, uid}}
+			}
+			if uid < cursor.spans[0].first {
+				cursor.spans[0].first = uid
+			}
+			if uid > cursor.spans[0].last {
+				cursor.spans[0].last = uid
+			}
+		}
+		byUID = true
+	}
+
+	if client.Mailbox.Messages == 0 {
+		// There is nothing to search, and a FETCH of sequence number 1
+		// fails on an empty mailbox. The watermark set above is kept.
+		s.Log.Infof("Mailbox %s is empty", mailbox)
+		cursor.spans, cursor.only = nil, nil
+	}
+
+	s.update(func(p *Progress) {
+		p.ToScan += cursor.size()
+		p.ScanDone = false
+	})
+
+	size := s.QueueSize
+	if size <= 0 {
+		size = DefaultQueueSize
+	}
+	out := make(chan msgID, size)
+
+	var wg sync.WaitGroup
+	for i := 0; i < s.ScanConnections; i++ {
+		wg.Add(1)
+		go func(id int, client *conn) {
+			defer wg.Done()
+			if client == nil {
+				s.Log.Debugf("IMAP[%d]: Connect", id)
+				var err error
+				client, err = s.connect(mailbox)
+				if err != nil {
+					s.fail(err)
+					return
+				}
+			}
+			defer s.released()
+			search := client.MsgIDSearch
+			if byUID {
+				search = client.UIDMsgIDSearch
+			}
+			s.scan(ctx, id, search, client.UIDMsgIDSearch, byUID, cursor, wm, out)
+		}(i, client)
+		client = nil
+	}
+
+	go func() {
+		wg.Wait()
+		s.update(func(p *Progress) {
+			p.ScanDone = true
+		})
+		close(out)
+	}()
+
+	return out, wm, nil
+}
+
+// scanSteps returns the initial, least and greatest scan step, with the
+// bounds widened to include the initial step.
+func (s *Syncer) scanSteps() (step, minStep, maxStep uint32) {
+	def := func(v, d int) uint32 {
+		if v <= 0 {
+			return uint32(d)
+		}
+		return uint32(v)
+	}
+	step = def(s.ScanStep, DefaultScanStep)
+	minStep = def(s.MinScanStep, DefaultMinScanStep)
+	maxStep = def(s.MaxScanStep, DefaultMaxScanStep)
+	if minStep > step {
+		minStep = step
+	}
+	if maxStep < step {
+		maxStep = step
+	}
+	return step, minStep, maxStep
+}
+
+// searchFunc returns the messages in a range of UIDs or sequence numbers.
+type searchFunc func(ctx context.Context, first, last uint32) ([]imap.MsgID, error)
+
+// scan searches the chunks handed out by cursor, by UID if byUID is set and
+// otherwise by sequence number, queuing the messages not in the vault.
+// Messages found without labels that have labels in the vault are searched
+// again by UID with recheck.
+func (s *Syncer) scan(ctx context.Context, id int, search, recheck searchFunc, byUID bool, cursor *scanCursor, wm *watermark, out chan<- msgID) {
+	step, minStep, maxStep := s.scanSteps()
+	for ctx.Err() == nil {
+		begin, end, ok := cursor.next(step)
+		if !ok {
+			return
+		}
+		s.Log.Debugf("IMAP[%d]: UID SEARCH %d:%d", id, begin, end)
+
+		msgids, err := search(ctx, begin, end)
+		if err != nil && ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			s.fail(err)
+			return
+		}
+		if cursor.only != nil {
+			var in []imap.MsgID
+			for _, msgid := range msgids {
+				if cursor.only[msgid.UID] {
+					in = append(in, msgid)
+				}
+			}
+			msgids = in
+		}
+		s.update(func(p *Progress) {
+			p.Scanned += len(msgids)
+		})
+
+		keep := s.confirmNoLabels(ctx, id, recheck, msgids)
+
+		var skip map[int64]bool
+		if len(s.ExcludeLabels) > 0 {
+			skip = make(map[int64]bool)
+			for i := range msgids {
+				labels, all := s.withoutExcluded(msgids[i].Labels)
+				msgids[i].Labels = labels
+				if all {
+					skip[msgids[i].MsgID] = true
+				}
+			}
+		}
+
+		// The labels and flags of the chunk are written before its
+		// messages are queued, so that a message record in the vault is
+		// always preceded by its labels
+		relabeled := 0
+		for _, msgid := range msgids {
+			if skip[msgid.MsgID] {
+				continue
+			}
+			changed := false
+			if !keep[msgid.MsgID] && !sliceEquals(msgid.Labels, s.Vault.Labels(msgid.MsgID)) {
+				if !s.DryRun {
+					s.Vault.SetLabels(msgid.MsgID, msgid.Labels)
+				}
+				changed = true
+			}
+			if !sliceEquals(msgid.Flags, s.Vault.Flags(msgid.MsgID)) {
+				if !s.DryRun {
+					s.Vault.SetFlags(msgid.MsgID, msgid.Flags)
+				}
+				changed = true
+			}
+			if changed {
+				relabeled++
+			}
+		}
+		if !s.DryRun {
+			err = s.Vault.WriteLabels()
+			if err != nil {
+				s.fail(err)
+				return
+			}
+		}
+
+		// A chunk of sequence numbers covers the UIDs between those of
+		// its first and last messages
+		var chunk *scanChunk
+		if byUID {
+			chunk = s.chunkStarted(begin, end)
+		} else if len(msgids) > 0 {
+			first, last := msgids[0].UID, msgids[0].UID
+			for _, msgid := range msgids {
+				if msgid.UID < first {
+					first = msgid.UID
+				}
+				if msgid.UID > last {
+					last = msgid.UID
+				}
+			}
+			chunk = s.chunkStarted(first, last)
+		}
+
+		fetch, queued := 0, true
+		for _, msgid := range msgids {
+			wm.update(msgid)
+			if skip[msgid.MsgID] {
+				continue
+			}
+			if !s.Vault.HaveUID(msgid.MsgID) && !(s.HeadersOnly && s.Vault.HaveHeader(msgid.MsgID)) {
+				s.chunkAdded(chunk)
+				select {
+				case out <- msgID{msgid.UID, msgid.MsgID, msgid.ThreadID, chunk}:
+					fetch++
+				case <-ctx.Done():
+					s.chunkDone(chunk, false)
+					queued = false
+				}
+			}
+		}
+		s.chunkDone(chunk, queued)
+
+		s.update(func(p *Progress) {
+			p.Queued += fetch
+			p.Labels += relabeled
+		})
+
+		prev := step
+		if fetch == 0 && step < maxStep {
+			// Scale up for faster scanning of known messages
+			step *= 2
+		} else if fetch > 0 && step > minStep {
+			// Scale down to avoid timeouts and write reasonable label
+			// chunks when we need to fetch lots of messages.
+			step /= 2
+		}
+		if step > maxStep {
+			step = maxStep
+		}
+		if step < minStep {
+			step = minStep
+		}
+		if step != prev {
+			s.Log.Debugf("IMAP[%d]: Scan step %d", id, step)
+		}
+	}
+}
+
+// confirmNoLabels searches again the messages in msgids that were found
+// without labels but have labels in the vault, so that a server glitch
+// doesn't strip them of their labels. The labels found the second time
+// replace those in msgids; the returned messages could not be searched again
+// and keep the labels in the vault.
+func (s *Syncer) confirmNoLabels(ctx context.Context, id int, recheck searchFunc, msgids []imap.MsgID) map[int64]bool {
+	var keep map[int64]bool
+	for i, msgid := range msgids {
+		if len(msgid.Labels) > 0 || len(s.Vault.Labels(msgid.MsgID)) == 0 {
+			continue
+		}
+		again, err := recheck(ctx, msgid.UID, msgid.UID)
+		if err == nil && (len(again) != 1 || again[0].MsgID != msgid.MsgID) {
+			err = errors.New("message not found")
+		}
+		if err != nil {
+			s.Log.Warnf("IMAP[%d]: Message %d (UID %d) was found without labels, keeping its labels: %v", id, msgid.MsgID, msgid.UID, err)
+			if keep == nil {
+				keep = make(map[int64]bool)
+			}
+			keep[msgid.MsgID] = true
+			continue
+		}
+		if len(again[0].Labels) > 0 {
+			s.Log.Warnf("IMAP[%d]: Message %d (UID %d) was found without labels, but with %d when searched again", id, msgid.MsgID, msgid.UID, len(again[0].Labels))
+		} else {
+			s.Log.Debugf("IMAP[%d]: Message %d (UID %d) confirmed to have no labels", id, msgid.MsgID, msgid.UID)
+		}
+		msgids[i].Labels = again[0].Labels
+	}
+	return keep
+}
+
+// searchWindow returns the UIDs of the messages to sync in the mailbox of
+// client, for a date range or backfill.
+func (s *Syncer) searchWindow(ctx context.Context, client *conn) ([]uint32, error) {
+	var uids []uint32
+	if s.Backfill {
+		msgids := s.Vault.HeaderOnly()
+		if len(msgids) == 0 {
+			s.Log.Infof("No messages stored headers only")
+			return nil, nil
+		}
+		var err error
+		uids, err = client.SearchMsgIDs(ctx, msgids)
+		if err != nil {
+			return nil, err
+		}
+		s.Log.Infof("Found %d of %d messages stored headers only", len(uids), len(msgids))
+	}
+	if s.dateRange() {
+		found, err := client.SearchDate(ctx, s.Since, s.Before)
+		if err != nil {
+			return nil, err
+		}
+		if s.Backfill {
+			in := make(map[uint32]bool)
+			for _, uid := range found {
+				in[uid] = true
+			}
+			found = nil
+			for _, uid := range uids {
+				if in[uid] {
+					found = append(found, uid)
+				}
+			}
+		}
+		uids = found
+		s.Log.Infof("Found %d messages in the date range", len(uids))
+	}
+	return uids, nil
+}
+
+// window returns whether the sync is limited to messages found by a search,
+// rather than scanning the mailbox for all new messages.
+func (s *Syncer) window() bool {
+	return s.dateRange() || s.Backfill
+}
+
+func (s *Syncer) dateRange() bool {
+	return !s.Since.IsZero() || !s.Before.IsZero()
+}
+
+// withoutExcluded returns labels without the excluded ones, and whether
+// there were labels and all were excluded.
+func (s *Syncer) withoutExcluded(labels []string) ([]string, bool) {
+	var kept []string
+	for _, l := range labels {
+		excluded := false
+		for _, e := range s.ExcludeLabels {
+			if strings.EqualFold(strings.TrimPrefix(l, "\\"), strings.TrimPrefix(e, "\\")) {
+				excluded = true
+				break
+			}
+		}
+		if !excluded {
+			kept = append(kept, l)
+		}
+	}
+	return kept, len(labels) > 0 && len(kept) == 0
+}
+
+// pruneDeleted records the deletion of the messages in the vault that were
+// not seen by a full scan of the mailbox.
+func (s *Syncer) pruneDeleted(seen map[int64]bool) {
+	if len(seen) == 0 {
+		// Most likely the wrong mailbox rather than everything deleted
+		s.Log.Warnf("Not pruning, no messages found in mailbox")
+		return
+	}
+
+	var deleted []int64
+	for _, msgid := range s.Vault.MessageIDs() {
+		if !seen[msgid] {
+			deleted = append(deleted, msgid)
+		}
+	}
+	if len(deleted) == 0 {
+		return
+	}
+	s.update(func(p *Progress) {
+		p.Pruned = len(deleted)
+	})
+	if s.DryRun {
+		return
+	}
+
+	err := s.Vault.WriteDelete(deleted)
+	if err != nil {
+		s.fail(err)
+		return
+	}
+	s.Log.Infof("Pruned %d deleted messages", len(deleted))
+}
+
+func sliceEquals(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,282 @@
+package syncer
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/calmh/gmailsync/db"
+)
+
+// testSyncer returns a Syncer for vault and srv with one scan and two fetch
+// connections.
+func testSyncer(vault *db.DB, srv *fakeServer) *Syncer {
+	return &Syncer{Vault: vault, Connections: 3, ScanConnections: 1, dial: srv.dial}
+}
+
+// checkStored fails t unless the messages of srv are in vault with their
+// labels and flags.
+func checkStored(t *testing.T, vault *db.DB, srv *fakeServer) {
+	t.Helper()
+	for _, m := range srv.msgs {
+		if !vault.HaveUID(m.msgid) {
+			t.Errorf("message %d not stored", m.msgid)
+		}
+		if got := vault.Labels(m.msgid); !sliceEquals(got, m.labels) {
+			t.Errorf("message %d has labels %v, not %v", m.msgid, got, m.labels)
+		}
+		if got := vault.Flags(m.msgid); !sliceEquals(got, m.flags) {
+			t.Errorf("message %d has flags %v, not %v", m.msgid, got, m.flags)
+		}
+	}
+}
+
+func TestFetch(t *testing.T) {
+	srv := newFakeServer(30)
+	vault := testVault(t)
+	s := testSyncer(vault, srv)
+	err := s.Fetch(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkStored(t, vault, srv)
+	if p := s.Progress(); p.Queued != 30 || p.Fetched != 30 || p.Labels != 30 {
+		t.Errorf("queued %d, fetched %d, relabeled %d; want 30 of each", p.Queued, p.Fetched, p.Labels)
+	}
+	last := srv.msgs[len(srv.msgs)-1]
+	if validity, uid := vault.Watermark(); validity != srv.validity || uid != last.uid {
+		t.Errorf("watermark is %d/%d, not %d/%d", validity, uid, srv.validity, last.uid)
+	}
+
+	// The next fetch resumes after the watermark
+	srv.fetched = nil
+	srv.msgs = append(srv.msgs, fakeMessage{uid: last.uid + 5, msgid: 2000, labels: []string{"Work"}, body: "Subject: new\r\n\r\nnew\r\n"})
+	err = s.Fetch(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkStored(t, vault, srv)
+	if len(srv.fetched) != 1 || srv.fetched[0] != last.uid+5 {
+		t.Errorf("fetched UIDs %v, not only the new message", srv.fetched)
+	}
+
+	// A full scan finds label changes on old messages
+	srv.msgs[0].labels = []string{`\Inbox`, "Receipts"}
+	srv.msgs[1].flags = nil
+	s.FullScan = true
+	err = s.Fetch(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkStored(t, vault, srv)
+	if p := s.Progress(); p.Queued != 0 || p.Labels != 2 {
+		t.Errorf("queued %d, relabeled %d; want 0 and 2", p.Queued, p.Labels)
+	}
+}
+
+// TestFetchOnProgress checks that OnProgress is called as each message is
+// stored, ending with the counts of the sync.
+func TestFetchOnProgress(t *testing.T) {
+	srv := newFakeServer(10)
+	s := testSyncer(testVault(t), srv)
+	var mut sync.Mutex
+	var calls []Progress
+	s.OnProgress = func(p Progress) {
+		defer mut.Unlock()
+		mut.Lock()
+		calls = append(calls, p)
+	}
+	err := s.Fetch(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var size int64
+	for _, m := range srv.msgs {
+		size += int64(len(m.body))
+	}
+	// Calls from different goroutines may arrive out of order, but every
+	// count is reported on the way
+	fetched := make(map[int]bool)
+	var last Progress
+	for _, p := range calls {
+		fetched[p.Fetched] = true
+		if p.Fetched > last.Fetched || p.Fetched == last.Fetched && p.Labels > last.Labels {
+			last = p
+		}
+	}
+	for n := 1; n <= 10; n++ {
+		if !fetched[n] {
+			t.Errorf("no progress reported with %d messages fetched", n)
+		}
+	}
+	if last.Queued != 10 || last.Fetched != 10 || last.Labels != 10 || last.Bytes != size {
+		t.Errorf("last progress reported queued %d, fetched %d, relabeled %d, %d bytes; want 10, 10, 10, %d", last.Queued, last.Fetched, last.Labels, last.Bytes, size)
+	}
+	if p := s.Progress(); p.Fetched != last.Fetched || p.Labels != last.Labels {
+		t.Errorf("final progress %+v was not reported", p)
+	}
+}
+
+func TestFetchWithoutGmail(t *testing.T) {
+	srv := newFakeServer(4)
+	srv.gmail = false
+	for i := range srv.msgs {
+		srv.msgs[i].labels = nil
+	}
+	vault := testVault(t)
+	err := testSyncer(vault, srv).Fetch(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range srv.msgs {
+		if msgid := int64(srv.validity)<<32 | int64(m.uid); !vault.HaveUID(msgid) {
+			t.Errorf("message UID %d not stored as %d", m.uid, msgid)
+		}
+	}
+}
+
+// TestFetchWorkersExit checks that the scan and fetch connections are all
+// released when the scan is done, for one and for many fetch connections.
+func TestFetchWorkersExit(t *testing.T) {
+	for _, conns := range []int{2, 8} {
+		srv := newFakeServer(50)
+		s := testSyncer(testVault(t), srv)
+		s.Connections = conns
+		done := make(chan error)
+		go func() {
+			done <- s.Fetch(context.Background())
+		}()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("fetch with %d connections did not return", conns)
+		}
+		if n := s.Progress().Connections; n != 0 {
+			t.Errorf("%d of %d connections still in use", n, conns)
+		}
+	}
+}
+
+func TestScanCursor(t *testing.T) {
+	cases := []struct {
+		reverse bool
+		want    []span
+	}{
+		{false, []span{{1, 2}, {3, 4}, {5, 5}}},
+		{true, []span{{4, 5}, {2, 3}, {1, 1}}},
+	}
+	for _, tc := range cases {
+		c := &scanCursor{spans: []span{{1, 5}}, reverse: tc.reverse}
+		var got []span
+		for {
+			begin, end, ok := c.next(2)
+			if !ok {
+				break
+			}
+			got = append(got, span{begin, end})
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("reverse %v: chunks %v, want %v", tc.reverse, got, tc.want)
+		}
+	}
+}
+
+// TestFetchLastMessage scans a mailbox whose size isn't a multiple of the
+// scan step, which must not leave out the last message.
+func TestFetchLastMessage(t *testing.T) {
+	for _, newest := range []bool{false, true} {
+		srv := newFakeServer(5)
+		vault := testVault(t)
+		s := testSyncer(vault, srv)
+		s.ScanStep, s.MinScanStep, s.MaxScanStep = 2, 2, 2
+		s.NewestFirst = newest
+		err := s.Fetch(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkStored(t, vault, srv)
+		if p := s.Progress(); p.Scanned != 5 || p.Queued != 5 {
+			t.Errorf("newest first %v: scanned %d, queued %d; want 5", newest, p.Scanned, p.Queued)
+		}
+		sort.Strings(srv.searches)
+		if want := []string{"1:2", "3:4", "5:5"}; !newest && !reflect.DeepEqual(srv.searches, want) {
+			t.Errorf("searched %v, not %v", srv.searches, want)
+		}
+	}
+}
+
+func TestFetchSmallMailbox(t *testing.T) {
+	cases := []struct {
+		msgs     int
+		searches []string
+	}{
+		// An empty mailbox isn't searched at all, as a search of
+		// sequence number 1 fails
+		{0, nil},
+		{1, []string{"1:1"}},
+	}
+	for _, tc := range cases {
+		srv := newFakeServer(tc.msgs)
+		vault := testVault(t)
+		s := testSyncer(vault, srv)
+		err := s.Fetch(context.Background())
+		if err != nil {
+			t.Fatalf("%d messages: %v", tc.msgs, err)
+		}
+		checkStored(t, vault, srv)
+		if !reflect.DeepEqual(srv.searches, tc.searches) {
+			t.Errorf("%d messages: searched %v, not %v", tc.msgs, srv.searches, tc.searches)
+		}
+		if p := s.Progress(); p.Fetched != tc.msgs || !p.ScanDone {
+			t.Errorf("%d messages: fetched %d, scan done %v", tc.msgs, p.Fetched, p.ScanDone)
+		}
+	}
+}
+
+func TestFetchDryRun(t *testing.T) {
+	srv := newFakeServer(5)
+	var storage db.MemoryStorage
+	vault, err := db.OpenStorage(&storage, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The first message is stored without labels, and one no longer on
+	// the server would be pruned
+	for _, msgid := range []int64{srv.msgs[0].msgid, 9999} {
+		err = vault.WriteMessage(msgid, []byte("Subject: old\r\n\r\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	vault.Close()
+	before := storage.Bytes()
+
+	vault, err = db.OpenStorageReadOnly(&storage, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := testSyncer(vault, srv)
+	s.DryRun, s.Prune = true, true
+	err = s.Fetch(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	vault.Close()
+	if p := s.Progress(); p.Queued != 4 || p.Labels != 5 || p.Pruned != 1 {
+		t.Errorf("queued %d, relabeled %d, pruned %d; want 4, 5 and 1", p.Queued, p.Labels, p.Pruned)
+	}
+	if len(srv.fetched) > 0 {
+		t.Errorf("dry run fetched UIDs %v", srv.fetched)
+	}
+	if !bytes.Equal(storage.Bytes(), before) {
+		t.Error("dry run changed the vault")
+	}
+}
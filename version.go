@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+
+	"github.com/calmh/gmailsync/db"
+)
+
+// version and commit are set at build time with
+//
+//	go build -ldflags "-X main.version=v1.2.0 -X main.commit=$(git rev-parse --short HEAD)"
+//
+// Without them the module version and VCS revision recorded by the Go
+// toolchain are used, if any.
+var (
+	version = "unknown"
+	commit  = "unknown"
+)
+
+func printVersion() {
+	v, c := version, commit
+	if info, ok := debug.ReadBuildInfo(); ok {
+		if v == "unknown" && info.Main.Version != "" && info.Main.Version != "(devel)" {
+			v = info.Main.Version
+		}
+		for _, s := range info.Settings {
+			if s.Key == "vcs.revision" && c == "unknown" {
+				c = s.Value
+			}
+		}
+	}
+	fmt.Printf("gmailsync %s (commit %s, %s, %s/%s, vault format %d)\n", v, c, runtime.Version(), runtime.GOOS, runtime.GOARCH, db.FileVersion)
+}